@@ -0,0 +1,300 @@
+//! Defaults for the command line options, read from a `.run-on-revisions.toml`
+//! file so that a repository's usual flags don't have to be repeated on every run
+
+use crate::{parse_since, parse_until, Opts};
+use eyre::{Result, WrapErr};
+use run_command_on_git_revisions::Format;
+use serde::{de, Deserialize, Deserializer};
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+use structopt::clap::ArgMatches;
+
+/// Name of the config file looked for in the repository and its parents
+pub const FILE_NAME: &str = ".run-on-revisions.toml";
+
+/// The options a config file may set, named like the long flags they stand
+/// in for.
+///
+/// Options which only make sense for a single run, such as the range, --limit
+/// or --bisect, are left out.
+#[derive(Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields, rename_all = "kebab-case")]
+pub struct Config {
+    shell: Option<bool>,
+    #[serde(rename = "path")]
+    paths: Option<Vec<PathBuf>>,
+    jobs: Option<usize>,
+    #[serde(deserialize_with = "duration")]
+    timeout: Option<Duration>,
+    #[serde(deserialize_with = "duration")]
+    max_runtime: Option<Duration>,
+    invert_exit: Option<bool>,
+    retries: Option<u32>,
+    #[serde(deserialize_with = "duration")]
+    retry_delay: Option<Duration>,
+    stop_on_failure: Option<bool>,
+    keep_going: Option<bool>,
+    reverse: Option<bool>,
+    first_parent: Option<bool>,
+    no_merges: Option<bool>,
+    tags_only: Option<bool>,
+    grep: Option<String>,
+    grep_invert: Option<bool>,
+    grep_i: Option<bool>,
+    author: Option<String>,
+    #[serde(deserialize_with = "since")]
+    since: Option<i64>,
+    #[serde(deserialize_with = "until")]
+    until: Option<i64>,
+    skip_file: Option<PathBuf>,
+    log_dir: Option<PathBuf>,
+    stash: Option<bool>,
+    force_checkout: Option<bool>,
+    no_checkout: Option<bool>,
+    submodules: Option<bool>,
+    timing: Option<bool>,
+    skip_if: Option<String>,
+    before: Option<String>,
+    after: Option<String>,
+    on_failure: Option<String>,
+    no_color: Option<bool>,
+    collect: Option<Vec<String>>,
+    collect_dir: Option<PathBuf>,
+    collect_passing_only: Option<bool>,
+    quiet: Option<bool>,
+    verbose: Option<bool>,
+    #[serde(deserialize_with = "format")]
+    format: Option<Format>,
+}
+
+fn duration<'de, D: Deserializer<'de>>(deserializer: D) -> Result<Option<Duration>, D::Error> {
+    let s = String::deserialize(deserializer)?;
+    humantime::parse_duration(&s)
+        .map(Some)
+        .map_err(de::Error::custom)
+}
+
+fn since<'de, D: Deserializer<'de>>(deserializer: D) -> Result<Option<i64>, D::Error> {
+    let s = String::deserialize(deserializer)?;
+    parse_since(&s).map(Some).map_err(de::Error::custom)
+}
+
+fn until<'de, D: Deserializer<'de>>(deserializer: D) -> Result<Option<i64>, D::Error> {
+    let s = String::deserialize(deserializer)?;
+    parse_until(&s).map(Some).map_err(de::Error::custom)
+}
+
+fn format<'de, D: Deserializer<'de>>(deserializer: D) -> Result<Option<Format>, D::Error> {
+    let s = String::deserialize(deserializer)?;
+    s.parse().map(Some).map_err(de::Error::custom)
+}
+
+/// Find the config file in `dir` or the nearest of its parents that has one
+pub fn discover(dir: &Path) -> Option<PathBuf> {
+    dir.ancestors()
+        .map(|dir| dir.join(FILE_NAME))
+        .find(|path| path.is_file())
+}
+
+/// The config file to read: the one given with --config, otherwise the one
+/// found from `dir` unless --no-config was given
+pub fn choose(config: Option<&Path>, no_config: bool, dir: &Path) -> Result<Option<PathBuf>> {
+    Ok(match (config, no_config) {
+        (Some(_), true) => eyre::bail!("--config and --no-config cannot be used together"),
+        (Some(path), false) => Some(path.to_path_buf()),
+        (None, true) => None,
+        (None, false) => discover(dir),
+    })
+}
+
+impl Config {
+    pub fn load(path: &Path) -> Result<Self> {
+        let text = std::fs::read_to_string(path)
+            .wrap_err_with(|| format!("reading config file {}", path.display()))?;
+        toml::from_str(&text).wrap_err_with(|| format!("parsing config file {}", path.display()))
+    }
+
+    /// Fill in the options in `opts` which were not given on the command line.
+    ///
+    /// Relative paths are taken from `dir`, the directory holding the file,
+    /// except for `path` filters which are always relative to the repository
+    /// root.
+    pub fn apply(mut self, opts: &mut Opts, matches: &ArgMatches, dir: &Path) {
+        let given = |name: &str| matches.occurrences_of(name) > 0;
+
+        // flags which cannot be combined replace the file's choice together
+        if given("quiet") || given("verbose") {
+            self.quiet = None;
+            self.verbose = None;
+        }
+        if given("stop-on-failure") || given("keep-going") {
+            self.stop_on_failure = None;
+            self.keep_going = None;
+        }
+
+        for path in [
+            &mut self.skip_file,
+            &mut self.log_dir,
+            &mut self.collect_dir,
+        ] {
+            *path = path.take().map(|path| dir.join(path));
+        }
+
+        // options are looked up by their argument names, which are kebab-case, and a
+        // flag's negation, such as --no-shell, also keeps the file's value out
+        macro_rules! set {
+            ($($field:ident: $name:literal $(| $negation:ident)?),*) => {$(
+                if let Some(value) = self.$field {
+                    if !given($name) $(&& !opts.$negation)? {
+                        opts.$field = value;
+                    }
+                }
+            )*};
+        }
+        macro_rules! set_some {
+            ($($field:ident: $name:literal),*) => {$(
+                if let Some(value) = self.$field {
+                    if !given($name) {
+                        opts.$field = Some(value);
+                    }
+                }
+            )*};
+        }
+
+        set!(
+            shell: "shell" | no_shell,
+            paths: "paths",
+            jobs: "jobs",
+            invert_exit: "invert-exit" | no_invert_exit,
+            retries: "retries",
+            retry_delay: "retry-delay",
+            stop_on_failure: "stop-on-failure",
+            keep_going: "keep-going",
+            reverse: "reverse" | no_reverse,
+            first_parent: "first-parent" | no_first_parent,
+            no_merges: "no-merges" | merges,
+            tags_only: "tags-only" | no_tags_only,
+            grep_invert: "grep-invert" | no_grep_invert,
+            grep_i: "grep-i" | no_grep_i,
+            stash: "stash" | no_stash,
+            force_checkout: "force-checkout" | no_force_checkout,
+            no_checkout: "no-checkout" | checkout,
+            submodules: "submodules" | no_submodules,
+            timing: "timing" | no_timing,
+            no_color: "no-color" | color,
+            collect: "collect",
+            collect_passing_only: "collect-passing-only" | no_collect_passing_only,
+            quiet: "quiet",
+            verbose: "verbose",
+            format: "format"
+        );
+        set_some!(
+            timeout: "timeout",
+            max_runtime: "max-runtime",
+            grep: "grep",
+            author: "author",
+            since: "since",
+            until: "until",
+            skip_file: "skip-file",
+            log_dir: "log-dir",
+            skip_if: "skip-if",
+            before: "before",
+            after: "after",
+            on_failure: "on-failure",
+            collect_dir: "collect-dir"
+        );
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use structopt::StructOpt;
+
+    /// Parse `args` as the command line and fill in the rest from `file`
+    fn apply(file: &str, args: &[&str]) -> Opts {
+        let matches = Opts::clap().get_matches_from(
+            ["run-command-on-git-revisions"].iter().chain(args).chain(&[
+                "HEAD~2..HEAD",
+                "--",
+                "true",
+            ]),
+        );
+        let mut opts = Opts::from_clap(&matches);
+        let config: Config = toml::from_str(file).unwrap();
+        config.apply(&mut opts, &matches, Path::new("/config"));
+        opts
+    }
+
+    const FILE: &str = r#"
+        jobs = 4
+        timeout = "5m"
+        shell = true
+        keep-going = true
+        verbose = true
+        format = "json"
+        log-dir = "logs"
+        path = ["src"]
+    "#;
+
+    #[test]
+    fn file_sets_defaults() {
+        let opts = apply(FILE, &[]);
+        assert_eq!(opts.jobs, 4);
+        assert_eq!(opts.timeout, Some(Duration::from_secs(5 * 60)));
+        assert!(opts.shell);
+        assert!(opts.keep_going);
+        assert!(opts.verbose);
+        assert_eq!(opts.format, Format::Json);
+        // relative to the file, except for path filters
+        assert_eq!(opts.log_dir, Some(PathBuf::from("/config/logs")));
+        assert_eq!(opts.paths, [PathBuf::from("src")]);
+    }
+
+    #[test]
+    fn flags_override_the_file() {
+        let args = [
+            "--jobs",
+            "2",
+            "--stop-on-failure",
+            "--quiet",
+            "--no-shell",
+            "--log-dir",
+            "here",
+        ];
+        let opts = apply(FILE, &args);
+        assert_eq!(opts.jobs, 2);
+        assert_eq!(opts.log_dir, Some(PathBuf::from("here")));
+        // the file's choice of a conflicting flag is dropped as well
+        assert!(opts.stop_on_failure && !opts.keep_going);
+        assert!(opts.quiet && !opts.verbose);
+        assert!(!opts.shell);
+        assert_eq!(opts.timeout, Some(Duration::from_secs(5 * 60)));
+    }
+
+    #[test]
+    fn unknown_keys_are_rejected() {
+        assert!(toml::from_str::<Config>("job = 4").is_err());
+        assert!(toml::from_str::<Config>("bisect = true").is_err());
+    }
+
+    #[test]
+    fn choose_finds_the_nearest_file_unless_told_not_to() {
+        let root = std::env::temp_dir().join(format!("config-test-{}", uuid::Uuid::new_v4()));
+        let nested = root.join("a").join("b");
+        std::fs::create_dir_all(&nested).unwrap();
+        let file = root.join(FILE_NAME);
+        std::fs::write(&file, "jobs = 2").unwrap();
+        let other = Path::new("/elsewhere/config.toml");
+
+        let found = (
+            choose(None, false, &nested).unwrap(),
+            choose(None, true, &nested).unwrap(),
+            choose(Some(other), false, &nested).unwrap(),
+            choose(Some(other), true, &nested).is_err(),
+        );
+        std::fs::remove_dir_all(&root).unwrap();
+
+        assert_eq!(found, (Some(file), None, Some(other.to_path_buf()), true));
+    }
+}
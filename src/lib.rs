@@ -0,0 +1,5406 @@
+//! Run a command on each commit in a range of a git repository.
+//!
+//! This is the library behind the `run-command-on-git-revisions` tool. Fill in
+//! [`Options`], then hand them to a [`Runner`] along with the repository:
+//!
+//! ```no_run
+//! use run_command_on_git_revisions::{Options, Runner};
+//!
+//! let options = Options {
+//!     start: "main~5".to_string(),
+//!     end: "main".to_string(),
+//!     command: vec!["cargo".to_string(), "test".to_string()],
+//!     ..Options::default()
+//! };
+//! let results = Runner::open(".", options)?
+//!     .on_result(|result| eprintln!("{} {}", result.oid, result.status()))
+//!     .run()?;
+//! assert!(results.passed());
+//! # Ok::<(), eyre::Report>(())
+//! ```
+use chrono::{DateTime, FixedOffset, NaiveDate, TimeZone, Utc};
+use eyre::{Result, WrapErr};
+use git2::Repository;
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use signal_hook::consts::{SIGINT, SIGTERM};
+use std::collections::{HashMap, HashSet};
+use std::io::{Read, Write};
+use std::path::{Path, PathBuf};
+use std::process::{Child, Command, Stdio};
+use std::str::FromStr;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex, MutexGuard};
+use std::thread::JoinHandle;
+use std::time::{Duration, Instant};
+use uuid::Uuid;
+
+/// Settings shared by every command invocation
+struct RunConfig {
+    command: Vec<String>,
+    shell: bool,
+    stop_on_failure: bool,
+    timeout: Option<Duration>,
+    retries: u32,
+    retry_delay: Duration,
+    interrupt: Interrupt,
+    /// When --max-runtime runs out, after which no more commits are started
+    deadline: Option<Instant>,
+    /// Set once a commit was left unstarted because the deadline passed
+    ran_out: AtomicBool,
+    format: Format,
+    log_dir: Option<PathBuf>,
+    no_checkout: bool,
+    submodules: bool,
+    stash: bool,
+    force_checkout: bool,
+    timing: bool,
+    skip_if: Option<String>,
+    before: Option<String>,
+    after: Option<String>,
+    on_failure: Option<String>,
+    invert_exit: bool,
+    /// Colour the tool's own lines written to `out`
+    color: bool,
+    /// Colour the tool's own lines written to `err`
+    color_stderr: bool,
+    /// The names of the tags pointing at each tagged commit
+    tags: HashMap<git2::Oid, Vec<String>>,
+    state: Option<StateFile>,
+    verbosity: Verbosity,
+    progress: Option<Progress>,
+    collect: Option<Collect>,
+    out: Output,
+    /// Where failures, progress and the tool's other messages go
+    err: Output,
+    on_result: Option<OnResult>,
+}
+
+impl RunConfig {
+    /// Whether --max-runtime has run out, noting that the run was cut short
+    fn out_of_time(&self) -> bool {
+        let expired = self
+            .deadline
+            .map_or(false, |deadline| Instant::now() >= deadline);
+        if expired {
+            self.ran_out.store(true, Ordering::SeqCst);
+        }
+        expired
+    }
+
+    /// Write one of the tool's own messages to `err` if the verbosity is at
+    /// least `level`, clearing an in-place progress line out of its way
+    fn log(&self, level: Verbosity, message: impl std::fmt::Display) {
+        if self.verbosity < level {
+            return;
+        }
+        let mut err = self.err.lock();
+        if let Some(progress) = &self.progress {
+            progress.clear(&mut *err);
+        }
+        let _ = writeln!(err, "{}", message);
+    }
+}
+
+/// Where results or messages are written, stdout or stderr outside of tests.
+/// Workers share it, so it is locked while each commit's lines are written
+struct Output(Mutex<Box<dyn Write + Send>>);
+
+impl Output {
+    fn new(writer: impl Write + Send + 'static) -> Self {
+        Self(Mutex::new(Box::new(writer)))
+    }
+
+    fn stdout() -> Self {
+        Self::new(std::io::stdout())
+    }
+
+    fn stderr() -> Self {
+        Self::new(std::io::stderr())
+    }
+
+    fn lock(&self) -> MutexGuard<'_, Box<dyn Write + Send>> {
+        self.0.lock().unwrap()
+    }
+}
+
+/// How much the tool reports about its own work
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Verbosity {
+    /// Only failures and a one line summary
+    Quiet,
+    Normal,
+    /// Also each checkout, and the environment and command line of everything run
+    Verbose,
+}
+
+/// How progress through the commits is shown on stderr
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ProgressStyle {
+    Off,
+    /// One line as each commit starts, for logs
+    Lines,
+    /// A single line rewritten as each commit starts, for terminals
+    InPlace,
+}
+
+/// Tracks how many commits have run, to show `[12/87] <hash>` and an
+/// estimate of the time left as each commit starts
+struct Progress {
+    style: ProgressStyle,
+    /// Highlight the commit being started
+    color: bool,
+    total: usize,
+    jobs: usize,
+    counts: Mutex<ProgressCounts>,
+}
+
+#[derive(Default)]
+struct ProgressCounts {
+    started: usize,
+    finished: usize,
+    /// Time spent running the command on the finished commits
+    elapsed: Duration,
+}
+
+impl Progress {
+    fn new(style: ProgressStyle, color: bool, total: usize, jobs: usize) -> Self {
+        Self {
+            style,
+            color,
+            total,
+            jobs,
+            counts: Mutex::new(ProgressCounts::default()),
+        }
+    }
+
+    fn start(&self, info: &CommitInfo, err: &mut dyn Write) {
+        let line = {
+            let mut counts = self.counts.lock().unwrap();
+            counts.started += 1;
+            let mut line = format!(
+                "[{}/{}] {}",
+                counts.started,
+                self.total,
+                paint(self.color, YELLOW, &info.short)
+            );
+            if counts.finished > 0 {
+                // a rough estimate, assuming the remaining commits take the mean time
+                let mean = counts.elapsed / counts.finished as u32;
+                let left = (self.total - counts.finished) as u32;
+                let eta = mean * left / self.jobs as u32;
+                let eta = humantime::format_duration(Duration::from_secs(eta.as_secs()));
+                line.push_str(&format!(" ETA {}", eta));
+            }
+            line
+        };
+        match self.style {
+            ProgressStyle::Off => {}
+            ProgressStyle::Lines => {
+                let _ = writeln!(err, "{}", line);
+            }
+            ProgressStyle::InPlace => {
+                let _ = write!(err, "\r\x1b[K{}", line);
+                let _ = err.flush();
+            }
+        }
+    }
+
+    fn finish(&self, duration: Duration) {
+        let mut counts = self.counts.lock().unwrap();
+        counts.finished += 1;
+        counts.elapsed += duration;
+    }
+
+    /// Erase an in-place progress line so that other output can be written
+    fn clear(&self, err: &mut dyn Write) {
+        if self.style == ProgressStyle::InPlace {
+            let _ = write!(err, "\r\x1b[K");
+        }
+    }
+}
+
+/// How results are written to stdout
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Format {
+    Human,
+    Json,
+    Csv,
+}
+
+impl FromStr for Format {
+    type Err = eyre::Report;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "human" => Ok(Format::Human),
+            "json" => Ok(Format::Json),
+            "csv" => Ok(Format::Csv),
+            other => eyre::bail!("unknown format {}, expected human, json or csv", other),
+        }
+    }
+}
+
+/// Records the signal, if any, which asked the run to stop early
+#[derive(Debug, Clone, Default)]
+pub struct Interrupt(Arc<AtomicUsize>);
+
+impl Interrupt {
+    /// Install handlers for SIGINT and SIGTERM which set the interrupt
+    pub fn install() -> Result<Self> {
+        let interrupt = Self::default();
+        for signal in [SIGINT, SIGTERM] {
+            signal_hook::flag::register_usize(signal, Arc::clone(&interrupt.0), signal as usize)
+                .wrap_err("installing signal handler")?;
+        }
+        Ok(interrupt)
+    }
+
+    pub fn signal(&self) -> Option<i32> {
+        match self.0.load(Ordering::SeqCst) {
+            0 => None,
+            signal => Some(signal as i32),
+        }
+    }
+
+    pub fn is_set(&self) -> bool {
+        self.signal().is_some()
+    }
+
+    /// Interrupt the run as if it had received `signal`
+    pub fn set(&self, signal: i32) {
+        self.0.store(signal as usize, Ordering::SeqCst);
+    }
+}
+
+/// How the command finished on one commit
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Outcome {
+    Exited(i32),
+    /// The --before command exited with this code, so the command was not run
+    SetupFailed(i32),
+    /// The --skip-if command failed, so the commit was not tested
+    Skipped,
+    TimedOut,
+    Interrupted,
+}
+
+/// The outcome of running the command on one commit
+#[derive(Debug)]
+pub struct CommitResult {
+    pub oid: git2::Oid,
+    pub subject: String,
+    /// Author date, in RFC 3339 format
+    pub date: String,
+    pub outcome: Outcome,
+    /// How long the command took, across all attempts
+    pub duration: Duration,
+    pub attempts: u32,
+    /// Whether a zero exit code counts as a failure and any other as a pass,
+    /// as with `--invert-exit`
+    pub inverted: bool,
+    /// Names of the tags pointing at the commit
+    pub tags: Vec<String>,
+    pub stdout: String,
+    pub stderr: String,
+}
+
+/// Whether the command exiting with `code` counts as a pass
+fn exit_passed(code: i32, inverted: bool) -> bool {
+    (code == 0) != inverted
+}
+
+impl CommitResult {
+    pub fn passed(&self) -> bool {
+        match self.outcome {
+            Outcome::Exited(code) => exit_passed(code, self.inverted),
+            _ => false,
+        }
+    }
+
+    /// Whether the commit counts as a failure. Skipped commits neither pass
+    /// nor fail
+    pub fn failed(&self) -> bool {
+        !self.passed() && self.outcome != Outcome::Skipped
+    }
+
+    pub fn status(&self) -> &'static str {
+        match self.outcome {
+            Outcome::Exited(_) if self.passed() => "PASS",
+            Outcome::Exited(_) => "FAIL",
+            Outcome::SetupFailed(_) => "SETUP_FAILED",
+            Outcome::TimedOut => "TIMEOUT",
+            Outcome::Interrupted => "INTERRUPTED",
+            Outcome::Skipped => "SKIPPED",
+        }
+    }
+
+    /// The colour used for the status in progress and summary lines
+    fn color(&self) -> &'static str {
+        match self.outcome {
+            Outcome::Exited(_) if self.passed() => GREEN,
+            Outcome::Exited(_) | Outcome::SetupFailed(_) | Outcome::TimedOut => RED,
+            Outcome::Interrupted => MAGENTA,
+            Outcome::Skipped => CYAN,
+        }
+    }
+
+    pub fn exit_code(&self) -> Option<i32> {
+        match self.outcome {
+            Outcome::Exited(code) | Outcome::SetupFailed(code) => Some(code),
+            Outcome::TimedOut | Outcome::Interrupted | Outcome::Skipped => None,
+        }
+    }
+}
+
+const RED: &str = "31";
+const GREEN: &str = "32";
+const YELLOW: &str = "33";
+const MAGENTA: &str = "35";
+const CYAN: &str = "36";
+
+/// Wrap `text` in the ANSI escape codes for `color` if colour is enabled
+fn paint(enabled: bool, color: &str, text: impl std::fmt::Display) -> String {
+    if enabled {
+        format!("\x1b[{}m{}\x1b[0m", color, text)
+    } else {
+        text.to_string()
+    }
+}
+
+fn short_id(oid: git2::Oid) -> String {
+    oid.to_string()[..7].to_string()
+}
+
+/// Metadata about a commit, exposed to the user's command
+#[derive(Debug)]
+struct CommitInfo {
+    oid: git2::Oid,
+    hash: String,
+    short: String,
+    author: String,
+    author_email: String,
+    date: String,
+    subject: String,
+    /// Names of the tags pointing at the commit, separated by spaces
+    tags: String,
+}
+
+impl CommitInfo {
+    fn load(repo: &Repository, oid: git2::Oid) -> Result<Self> {
+        let commit = repo
+            .find_commit(oid)
+            .wrap_err_with(|| format!("finding commit {}", oid))?;
+        let author = commit.author();
+        let when = author.when();
+        let date = FixedOffset::east_opt(when.offset_minutes() * 60)
+            .and_then(|tz| tz.timestamp_opt(when.seconds(), 0).single())
+            .map(|date| date.to_rfc3339())
+            .unwrap_or_default();
+
+        Ok(Self {
+            oid,
+            hash: oid.to_string(),
+            short: short_id(oid),
+            author: author.name().unwrap_or_default().to_string(),
+            author_email: author.email().unwrap_or_default().to_string(),
+            date,
+            subject: commit.summary().unwrap_or_default().to_string(),
+            tags: String::new(),
+        })
+    }
+
+    fn env_vars(&self) -> [(&'static str, &str); 7] {
+        [
+            ("GIT_REV_HASH", self.hash.as_str()),
+            ("GIT_REV_SHORT", self.short.as_str()),
+            ("GIT_REV_AUTHOR", self.author.as_str()),
+            ("GIT_REV_AUTHOR_EMAIL", self.author_email.as_str()),
+            ("GIT_REV_DATE", self.date.as_str()),
+            ("GIT_REV_SUBJECT", self.subject.as_str()),
+            ("GIT_REV_TAGS", self.tags.as_str()),
+        ]
+    }
+
+    /// The value of the `{name}` placeholder, along with the variable which
+    /// also holds it
+    fn placeholder(&self, name: &str) -> Option<(&'static str, &str)> {
+        match name {
+            "hash" => Some(("GIT_REV_HASH", self.hash.as_str())),
+            "short" => Some(("GIT_REV_SHORT", self.short.as_str())),
+            "author" => Some(("GIT_REV_AUTHOR", self.author.as_str())),
+            "date" => Some(("GIT_REV_DATE", self.date.as_str())),
+            "subject" => Some(("GIT_REV_SUBJECT", self.subject.as_str())),
+            _ => None,
+        }
+    }
+}
+
+/// Replace the `{name}` placeholders in `template` with the commit's metadata.
+///
+/// Unknown placeholders are left as they are, and `{{`/`}}` produce literal braces.
+fn substitute(template: &str, info: &CommitInfo) -> String {
+    expand(template, info, |_, value| value.to_string())
+}
+
+/// Replace the placeholders in a script for the shell with quoted references
+/// to the matching `GIT_REV_*` variables rather than their values, so that a
+/// commit subject or author name is never run as shell syntax
+fn substitute_for_shell(template: &str, info: &CommitInfo) -> String {
+    expand(template, info, |var, _| {
+        if cfg!(windows) {
+            // expanded after the line is parsed, see shell_command
+            format!("\"!{}!\"", var)
+        } else {
+            format!("\"${}\"", var)
+        }
+    })
+}
+
+fn expand(
+    template: &str,
+    info: &CommitInfo,
+    replace: impl Fn(&'static str, &str) -> String,
+) -> String {
+    let mut out = String::with_capacity(template.len());
+    let mut rest = template;
+    while let Some(pos) = rest.find(&['{', '}'][..]) {
+        out.push_str(&rest[..pos]);
+        rest = &rest[pos..];
+
+        if rest.starts_with("{{") || rest.starts_with("}}") {
+            out.push_str(&rest[..1]);
+            rest = &rest[2..];
+            continue;
+        }
+
+        if rest.starts_with('{') {
+            if let Some(end) = rest.find('}') {
+                if let Some((var, value)) = info.placeholder(&rest[1..end]) {
+                    out.push_str(&replace(var, value));
+                    rest = &rest[end + 1..];
+                    continue;
+                }
+            }
+        }
+
+        out.push_str(&rest[..1]);
+        rest = &rest[1..];
+    }
+    out.push_str(rest);
+    out
+}
+
+/// Resolve anything `git rev-parse` accepts, such as an abbreviated hash, a
+/// branch or tag name, or `HEAD~3`, to the commit it points at
+pub fn resolve_commit(repo: &Repository, rev: &str) -> Result<git2::Oid> {
+    let obj = match repo.revparse_single(rev) {
+        Ok(obj) => obj,
+        Err(e) => {
+            let hint = match e.code() {
+                git2::ErrorCode::Ambiguous => {
+                    "the abbreviated hash matches several objects, give more of it"
+                }
+                _ => "expected a commit hash, branch, tag or relative ref such as HEAD~3 or main^",
+            };
+            return Err(e).wrap_err_with(|| format!("resolving revision {}: {}", rev, hint));
+        }
+    };
+    let commit = obj
+        .peel_to_commit()
+        .wrap_err_with(|| format!("revision {} does not point at a commit", rev))?;
+    Ok(commit.id())
+}
+
+/// Fetch from `remote`, including its tags, so that revisions which only
+/// exist there can be resolved.
+///
+/// The fetch is left to git so that the user's SSH agent and credential
+/// helpers are used.
+pub fn fetch(repo: &Repository, remote: &str) -> Result<()> {
+    let dir = repo.workdir().unwrap_or_else(|| repo.path());
+    repo.find_remote(remote)
+        .wrap_err_with(|| format!("no remote named {} is configured", remote))?;
+    tracing::debug!(%remote, "fetching");
+    git(dir, &["fetch", "--quiet", "--tags", remote]).map_err(|e| {
+        let message = format!("{:#}", e);
+        let auth = [
+            "Permission denied",
+            "Authentication failed",
+            "could not read Username",
+            "Host key verification failed",
+        ];
+        if auth.iter().any(|needle| message.contains(needle)) {
+            e.wrap_err(format!(
+                "could not authenticate with remote {}, check that `git fetch {}` works with your SSH key or access token",
+                remote, remote
+            ))
+        } else {
+            e.wrap_err(format!("fetching from remote {}", remote))
+        }
+    })
+}
+
+/// Split a git style revision range into start and end revisions.
+///
+/// `A..B` walks from `A` to `B`, while `A...B` walks from the merge base of
+/// `A` and `B` to `B`. A missing side defaults to `HEAD`, as with git.
+pub fn parse_range(repo: &Repository, range: &str) -> Result<(String, String)> {
+    let (start, end, symmetric) = if let Some((start, end)) = range.split_once("...") {
+        (start, end, true)
+    } else if let Some((start, end)) = range.split_once("..") {
+        (start, end, false)
+    } else {
+        eyre::bail!(
+            "invalid revision range {}, expected START..END or START...END",
+            range
+        );
+    };
+
+    let start = if start.is_empty() { "HEAD" } else { start };
+    let end = if end.is_empty() { "HEAD" } else { end };
+
+    if symmetric {
+        let base = repo
+            .merge_base(resolve_commit(repo, start)?, resolve_commit(repo, end)?)
+            .wrap_err_with(|| format!("finding merge base of {} and {}", start, end))?;
+        Ok((base.to_string(), end.to_string()))
+    } else {
+        Ok((start.to_string(), end.to_string()))
+    }
+}
+
+/// Controls how history is walked between the start and end revisions
+#[derive(Debug, Clone, Default)]
+pub struct WalkOptions {
+    pub first_parent: bool,
+    pub no_merges: bool,
+    pub paths: Vec<PathBuf>,
+    pub grep: Option<Regex>,
+    pub grep_invert: bool,
+    /// Author name or email substring, matched ignoring case
+    pub author: Option<String>,
+    /// Inclusive bounds on the author date, in seconds since the epoch
+    pub since: Option<i64>,
+    pub until: Option<i64>,
+    /// Only keep commits which at least one tag points at
+    pub tags_only: bool,
+}
+
+/// Parse a date bound given as an RFC 3339 time or a bare `YYYY-MM-DD` date,
+/// which is taken in UTC
+pub fn parse_date_bound(s: &str, end_of_day: bool) -> Result<i64> {
+    if let Ok(time) = DateTime::parse_from_rfc3339(s) {
+        return Ok(time.timestamp());
+    }
+    let date = NaiveDate::parse_from_str(s, "%Y-%m-%d")
+        .wrap_err_with(|| format!("invalid date {}, expected RFC 3339 or YYYY-MM-DD", s))?;
+    let time = if end_of_day {
+        date.and_hms_opt(23, 59, 59)
+    } else {
+        date.and_hms_opt(0, 0, 0)
+    }
+    .expect("valid time of day");
+    Ok(Utc.from_utc_datetime(&time).timestamp())
+}
+
+/// Resolve an explicit list of revisions, keeping their order. Revisions
+/// which do not resolve are reported and left out, or are an error with
+/// `strict`
+fn resolve_revs(
+    repo: &Repository,
+    revs: &[String],
+    strict: bool,
+    config: &RunConfig,
+) -> Result<Vec<git2::Oid>> {
+    let mut commits = Vec::with_capacity(revs.len());
+    for rev in revs {
+        match resolve_commit(repo, rev) {
+            Ok(oid) => commits.push(oid),
+            Err(e) if strict => return Err(e.wrap_err("resolving --revs")),
+            Err(e) => config.log(
+                Verbosity::Normal,
+                format_args!("Skipping revision {}: {:#}", rev, e),
+            ),
+        }
+    }
+    Ok(commits)
+}
+
+/// Read a list of commits to leave out, one hash per line. Hashes may be
+/// abbreviated, and blank lines and `#` comments are ignored
+pub fn read_skip_file(path: &Path) -> Result<Vec<String>> {
+    let contents = std::fs::read_to_string(path)
+        .wrap_err_with(|| format!("reading skip file {}", path.display()))?;
+    let mut hashes = Vec::new();
+    for (number, line) in contents.lines().enumerate() {
+        let hash = match line.split_once('#') {
+            Some((hash, _comment)) => hash,
+            None => line,
+        }
+        .trim();
+        if hash.is_empty() {
+            continue;
+        }
+        if !hash.chars().all(|c| c.is_ascii_hexdigit()) {
+            eyre::bail!(
+                "{}:{}: {} is not a commit hash",
+                path.display(),
+                number + 1,
+                hash
+            );
+        }
+        hashes.push(hash.to_lowercase());
+    }
+    Ok(hashes)
+}
+
+/// Check that `end` descends from `start`, so that the range between them is a
+/// single line of history, explaining how they relate if not
+fn ensure_linear(
+    repo: &Repository,
+    (start, start_oid): (&str, git2::Oid),
+    (end, end_oid): (&str, git2::Oid),
+) -> Result<()> {
+    if start_oid == end_oid || repo.graph_descendant_of(end_oid, start_oid)? {
+        return Ok(());
+    }
+    if repo.graph_descendant_of(start_oid, end_oid)? {
+        eyre::bail!(
+            "start revision {} is newer than end revision {}, swap them and add --reverse to visit the newest first",
+            start,
+            end
+        );
+    }
+    match repo.merge_base(start_oid, end_oid) {
+        Ok(base) => eyre::bail!(
+            "start revision {} is not an ancestor of end revision {}: they diverged after their merge base {}. \
+             To run on the commits of {} since then, use the symmetric range {}...{}",
+            start,
+            end,
+            short_id(base),
+            end,
+            start,
+            end
+        ),
+        Err(e) if e.code() == git2::ErrorCode::NotFound => eyre::bail!(
+            "start revision {} and end revision {} share no history",
+            start,
+            end
+        ),
+        Err(e) => Err(e).wrap_err_with(|| format!("finding merge base of {} and {}", start, end)),
+    }
+}
+
+/// Collect the commits from `start` to `end` inclusive, oldest first
+#[tracing::instrument(skip(repo))]
+fn get_commits(
+    repo: &Repository,
+    start: &str,
+    end: &str,
+    options: &WalkOptions,
+    tags: &HashMap<git2::Oid, Vec<String>>,
+) -> Result<Vec<git2::Oid>> {
+    tracing::debug!(%start, %end, "getting commits");
+    let start_oid = resolve_commit(repo, start)?;
+    let end_oid = resolve_commit(repo, end)?;
+
+    ensure_linear(repo, (start, start_oid), (end, end_oid))?;
+
+    let mut walk = repo.revwalk()?;
+    walk.set_sorting(git2::Sort::TOPOLOGICAL | git2::Sort::REVERSE)?;
+    if options.first_parent {
+        walk.simplify_first_parent()?;
+    }
+    walk.push(end_oid).wrap_err("defining walk range")?;
+    // hide the parents rather than start itself so that start is included
+    for parent in repo.find_commit(start_oid)?.parent_ids() {
+        walk.hide(parent).wrap_err("defining walk range")?;
+    }
+
+    let mut commits = Vec::new();
+    for oid in walk {
+        let oid = oid.wrap_err("walking history")?;
+        if options.tags_only && !tags.contains_key(&oid) {
+            tracing::trace!(%oid, "filtered out untagged commit");
+            continue;
+        }
+        let commit = repo.find_commit(oid)?;
+        if keep_commit(repo, &commit, options)? {
+            commits.push(oid);
+        } else {
+            tracing::trace!(%oid, "filtered out commit");
+        }
+    }
+    Ok(commits)
+}
+
+/// Find the tags pointing at each commit, with their names sorted.
+///
+/// Annotated tags are peeled to the commit they tag, and tags of anything
+/// other than a commit are ignored.
+fn tag_map(repo: &Repository) -> Result<HashMap<git2::Oid, Vec<String>>> {
+    let mut tags: HashMap<git2::Oid, Vec<String>> = HashMap::new();
+    for reference in repo
+        .references_glob("refs/tags/*")
+        .wrap_err("listing tags")?
+    {
+        let reference = reference.wrap_err("listing tags")?;
+        let (name, commit) = match (reference.shorthand(), reference.peel_to_commit()) {
+            (Some(name), Ok(commit)) => (name.to_string(), commit.id()),
+            _ => continue,
+        };
+        tags.entry(commit).or_default().push(name);
+    }
+    for names in tags.values_mut() {
+        names.sort();
+    }
+    Ok(tags)
+}
+
+/// Whether a commit in the walked range passes the user's filters
+fn keep_commit(repo: &Repository, commit: &git2::Commit, options: &WalkOptions) -> Result<bool> {
+    if options.no_merges && commit.parent_count() > 1 {
+        return Ok(false);
+    }
+    let author = commit.author();
+    if let Some(needle) = &options.author {
+        let needle = needle.to_lowercase();
+        let matches = [author.name(), author.email()]
+            .iter()
+            .flatten()
+            .any(|field| field.to_lowercase().contains(&needle));
+        if !matches {
+            return Ok(false);
+        }
+    }
+    let date = author.when().seconds();
+    if options.since.map_or(false, |since| date < since)
+        || options.until.map_or(false, |until| date > until)
+    {
+        return Ok(false);
+    }
+    if let Some(grep) = &options.grep {
+        let message = String::from_utf8_lossy(commit.message_bytes());
+        if grep.is_match(&message) == options.grep_invert {
+            return Ok(false);
+        }
+    }
+    if !options.paths.is_empty() && !touches_paths(repo, commit, &options.paths)? {
+        return Ok(false);
+    }
+    Ok(true)
+}
+
+/// Whether a commit changes anything under `paths` compared to its first parent
+fn touches_paths(repo: &Repository, commit: &git2::Commit, paths: &[PathBuf]) -> Result<bool> {
+    let tree = commit.tree()?;
+    let parent_tree = match commit.parent_count() {
+        0 => None,
+        _ => Some(commit.parent(0)?.tree()?),
+    };
+
+    let mut opts = git2::DiffOptions::new();
+    for path in paths {
+        opts.pathspec(path.as_path());
+    }
+    let diff = repo
+        .diff_tree_to_tree(parent_tree.as_ref(), Some(&tree), Some(&mut opts))
+        .wrap_err_with(|| format!("diffing commit {}", commit.id()))?;
+    Ok(diff.deltas().next().is_some())
+}
+
+/// The order in which commits are visited
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Direction {
+    OldestFirst,
+    NewestFirst,
+}
+
+/// Order commits collected oldest first by `get_commits` for execution
+fn order_commits(mut commits: Vec<git2::Oid>, direction: Direction) -> Vec<git2::Oid> {
+    if direction == Direction::NewestFirst {
+        commits.reverse();
+    }
+    commits
+}
+
+/// Force a checkout of `oid` with a detached HEAD.
+///
+/// With `submodules` the checkout is left to git, which also adds, removes
+/// and moves submodule working trees, and submodules are then updated to the
+/// commits recorded in `oid`, cloning any that are new.
+fn checkout(repo: &Repository, oid: git2::Oid, submodules: bool) -> Result<()> {
+    if submodules {
+        let workdir = repo
+            .workdir()
+            .ok_or_else(|| eyre::eyre!("repository has no working tree"))?;
+        let rev = oid.to_string();
+        git(
+            workdir,
+            &[
+                "checkout",
+                "--quiet",
+                "--force",
+                "--recurse-submodules",
+                "--detach",
+                &rev,
+            ],
+        )?;
+        // submodule urls may differ between revisions
+        git(workdir, &["submodule", "sync", "--quiet", "--recursive"])?;
+        return git(
+            workdir,
+            &[
+                "submodule",
+                "update",
+                "--quiet",
+                "--init",
+                "--recursive",
+                "--force",
+            ],
+        )
+        .wrap_err("updating submodules");
+    }
+
+    let obj = repo.revparse_single(&oid.to_string())?;
+    let mut checkout_options = git2::build::CheckoutBuilder::new();
+    checkout_options.force();
+    repo.checkout_tree(&obj, Some(&mut checkout_options))?;
+    repo.set_head_detached(obj.id())?;
+    Ok(())
+}
+
+/// Where HEAD pointed before the run started
+#[derive(Debug)]
+enum OriginalHead {
+    Branch(String),
+    Detached(git2::Oid),
+}
+
+/// Restores HEAD to its original branch or commit when dropped, so that the
+/// user's checkout is put back however the run ends
+struct RestoreHead<'r> {
+    repo: &'r Repository,
+    original: Option<OriginalHead>,
+    /// Whether the user's changes were stashed and should be popped again
+    stashed: bool,
+    /// For whether submodules are updated along with each checkout, and
+    /// where to report a failure to restore, since dropping cannot return it
+    config: &'r RunConfig,
+}
+
+impl<'r> RestoreHead<'r> {
+    fn record(repo: &'r Repository, config: &'r RunConfig) -> Result<Self> {
+        let head = repo.head().wrap_err("reading HEAD")?;
+        let original = if head.is_branch() {
+            let name = head
+                .name()
+                .ok_or_else(|| eyre::eyre!("branch name is not valid utf-8"))?;
+            OriginalHead::Branch(name.to_string())
+        } else {
+            let commit = head.peel_to_commit().wrap_err("non-commit target")?;
+            OriginalHead::Detached(commit.id())
+        };
+        tracing::debug!(?original, "recorded original HEAD");
+        Ok(Self {
+            repo,
+            original: Some(original),
+            stashed: false,
+            config,
+        })
+    }
+
+    /// Restore HEAD now, reporting any failure to the caller
+    fn restore(mut self) -> Result<()> {
+        self.restore_inner()
+    }
+
+    fn restore_inner(&mut self) -> Result<()> {
+        let stashed = std::mem::take(&mut self.stashed);
+        if let Err(e) = self.restore_head() {
+            // popping onto the wrong commit would only make things worse
+            if stashed {
+                return Err(e.wrap_err("your uncommitted changes are still in the stash"));
+            }
+            return Err(e);
+        }
+        if stashed {
+            let workdir = self
+                .repo
+                .workdir()
+                .ok_or_else(|| eyre::eyre!("repository has no working tree"))?;
+            git(workdir, &["stash", "pop", "--quiet"])
+                .wrap_err("restoring stashed changes with git stash pop")?;
+        }
+        Ok(())
+    }
+
+    fn restore_head(&mut self) -> Result<()> {
+        match self.original.take() {
+            Some(OriginalHead::Branch(name)) => {
+                let commit = self
+                    .repo
+                    .find_reference(&name)
+                    .and_then(|r| r.peel_to_commit())
+                    .wrap_err_with(|| format!("finding branch {}", name))?;
+                checkout(self.repo, commit.id(), self.config.submodules)
+                    .wrap_err_with(|| format!("checking out branch {}", name))?;
+                self.repo
+                    .set_head(&name)
+                    .wrap_err_with(|| format!("pointing HEAD at {}", name))?;
+            }
+            Some(OriginalHead::Detached(oid)) => {
+                checkout(self.repo, oid, self.config.submodules)
+                    .wrap_err_with(|| format!("checking out commit {}", oid))?;
+            }
+            None => {}
+        }
+        Ok(())
+    }
+}
+
+impl Drop for RestoreHead<'_> {
+    fn drop(&mut self) {
+        if let Err(e) = self.restore_inner() {
+            tracing::error!(error = ?e, "failed to restore original HEAD");
+            self.config.log(
+                Verbosity::Quiet,
+                format_args!("Failed to restore original HEAD: {:?}", e),
+            );
+        }
+    }
+}
+
+/// List the tracked files with uncommitted changes, since checking out other
+/// revisions would discard them
+fn dirty_files(repo: &Repository) -> Result<Vec<String>> {
+    let mut opts = git2::StatusOptions::new();
+    opts.include_untracked(false).include_ignored(false);
+    let statuses = repo.statuses(Some(&mut opts)).wrap_err("reading status")?;
+    Ok(statuses
+        .iter()
+        .map(|entry| entry.path().unwrap_or("<non utf-8 path>").to_string())
+        .collect())
+}
+
+/// Find the untracked files that checking out any of `commits` would
+/// overwrite, with the first commit that tracks each one.
+///
+/// A file conflicts if a commit tracks something at its path, or tracks a
+/// file where the untracked file needs a directory.
+fn untracked_conflicts(
+    repo: &Repository,
+    commits: &[git2::Oid],
+) -> Result<Vec<(String, git2::Oid)>> {
+    let mut opts = git2::StatusOptions::new();
+    opts.include_untracked(true)
+        .recurse_untracked_dirs(true)
+        .include_ignored(false);
+    let statuses = repo.statuses(Some(&mut opts)).wrap_err("reading status")?;
+    let mut untracked: Vec<String> = statuses
+        .iter()
+        .filter(|entry| entry.status().contains(git2::Status::WT_NEW))
+        .filter_map(|entry| entry.path().map(str::to_string))
+        .collect();
+
+    let mut conflicts = Vec::new();
+    for oid in commits {
+        if untracked.is_empty() {
+            break;
+        }
+        let tree = repo.find_commit(*oid)?.tree()?;
+        untracked.retain(|path| {
+            let path = Path::new(path);
+            let clobbered = tree.get_path(path).is_ok()
+                || path
+                    .ancestors()
+                    .skip(1)
+                    .filter(|dir| !dir.as_os_str().is_empty())
+                    .any(|dir| {
+                        tree.get_path(dir)
+                            .map(|entry| entry.kind() != Some(git2::ObjectType::Tree))
+                            .unwrap_or(false)
+                    });
+            if clobbered {
+                conflicts.push((path.display().to_string(), *oid));
+            }
+            !clobbered
+        });
+    }
+    conflicts.sort();
+    Ok(conflicts)
+}
+
+/// Run a git subcommand in `dir`, failing with its stderr if it does not succeed
+fn git(dir: &Path, args: &[&str]) -> Result<()> {
+    let output = Command::new("git")
+        .current_dir(dir)
+        .args(args)
+        .output()
+        .wrap_err("spawning git")?;
+    if !output.status.success() {
+        eyre::bail!(
+            "git {} failed: {}",
+            args.join(" "),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+/// A temporary directory, removed again when dropped
+struct TempDir {
+    path: PathBuf,
+}
+
+impl TempDir {
+    fn new(label: &str) -> Result<Self> {
+        let path = std::env::temp_dir().join(format!(
+            "run-command-on-git-revisions-{}-{}",
+            label,
+            Uuid::new_v4()
+        ));
+        std::fs::create_dir_all(&path)
+            .wrap_err_with(|| format!("creating temporary directory {}", path.display()))?;
+        Ok(Self { path })
+    }
+}
+
+impl Drop for TempDir {
+    fn drop(&mut self) {
+        if let Err(e) = std::fs::remove_dir_all(&self.path) {
+            tracing::warn!(path = %self.path.display(), error = %e, "failed to remove temporary directory");
+        }
+    }
+}
+
+/// Write out the files of a commit's tree under `dest`, without touching the
+/// repository's index or working tree
+fn export_tree(repo: &Repository, oid: git2::Oid, dest: &Path) -> Result<()> {
+    let tree = repo.find_commit(oid)?.tree()?;
+    let mut error = None;
+    let walked = tree.walk(
+        git2::TreeWalkMode::PreOrder,
+        |root, entry| match export_entry(repo, &dest.join(root), entry) {
+            Ok(()) => git2::TreeWalkResult::Ok,
+            Err(e) => {
+                error = Some(e);
+                git2::TreeWalkResult::Abort
+            }
+        },
+    );
+    if let Some(e) = error {
+        return Err(e);
+    }
+    walked.wrap_err("walking tree")
+}
+
+const MODE_EXECUTABLE: i32 = 0o100755;
+const MODE_SYMLINK: i32 = 0o120000;
+
+fn export_entry(repo: &Repository, dir: &Path, entry: &git2::TreeEntry) -> Result<()> {
+    let name = entry
+        .name()
+        .ok_or_else(|| eyre::eyre!("tree entry name is not valid utf-8"))?;
+    let path = dir.join(name);
+
+    match entry.kind() {
+        // submodules are recorded as commits, leave an empty directory in their place
+        Some(git2::ObjectType::Tree) | Some(git2::ObjectType::Commit) => {
+            std::fs::create_dir_all(&path)?;
+        }
+        Some(git2::ObjectType::Blob) => {
+            let object = entry.to_object(repo)?;
+            let blob = object
+                .as_blob()
+                .ok_or_else(|| eyre::eyre!("{} is not a blob", path.display()))?;
+            write_blob(&path, blob.content(), entry.filemode())
+                .wrap_err_with(|| format!("writing {}", path.display()))?;
+        }
+        _ => tracing::debug!(path = %path.display(), "skipping unknown tree entry"),
+    }
+    Ok(())
+}
+
+#[cfg(unix)]
+fn write_blob(path: &Path, content: &[u8], mode: i32) -> std::io::Result<()> {
+    use std::ffi::OsStr;
+    use std::os::unix::ffi::OsStrExt;
+    use std::os::unix::fs::PermissionsExt;
+
+    match mode {
+        MODE_SYMLINK => std::os::unix::fs::symlink(OsStr::from_bytes(content), path),
+        MODE_EXECUTABLE => {
+            std::fs::write(path, content)?;
+            std::fs::set_permissions(path, std::fs::Permissions::from_mode(0o755))
+        }
+        _ => std::fs::write(path, content),
+    }
+}
+
+#[cfg(not(unix))]
+fn write_blob(path: &Path, content: &[u8], _mode: i32) -> std::io::Result<()> {
+    std::fs::write(path, content)
+}
+
+/// A temporary `git worktree`, removed again when dropped
+struct TempWorktree {
+    repo_dir: PathBuf,
+    path: PathBuf,
+}
+
+impl TempWorktree {
+    fn add(repo_dir: &Path, path: PathBuf) -> Result<Self> {
+        let output = Command::new("git")
+            .current_dir(repo_dir)
+            .args(&["worktree", "add", "--detach"])
+            .arg(&path)
+            .output()
+            .wrap_err("spawning git worktree add")?;
+        if !output.status.success() {
+            eyre::bail!(
+                "adding worktree at {}: {}",
+                path.display(),
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+        Ok(Self {
+            repo_dir: repo_dir.to_path_buf(),
+            path,
+        })
+    }
+}
+
+impl Drop for TempWorktree {
+    fn drop(&mut self) {
+        let removed = Command::new("git")
+            .current_dir(&self.repo_dir)
+            .args(&["worktree", "remove", "--force"])
+            .arg(&self.path)
+            .output()
+            .map(|output| output.status.success())
+            .unwrap_or(false);
+        if !removed {
+            tracing::warn!(path = %self.path.display(), "failed to remove worktree");
+            let _ = std::fs::remove_dir_all(&self.path);
+        }
+        let _ = Command::new("git")
+            .current_dir(&self.repo_dir)
+            .args(&["worktree", "prune"])
+            .output();
+    }
+}
+
+/// Temporary worktrees for the parallel workers, along with the directory holding them
+struct WorktreePool {
+    // fields are dropped in order, so the worktrees go before their parent directory
+    worktrees: Vec<TempWorktree>,
+    _base: TempDir,
+}
+
+impl WorktreePool {
+    fn new(repo_dir: &Path, count: usize) -> Result<Self> {
+        let base = TempDir::new("worktrees")?;
+        let worktrees = (0..count)
+            .map(|i| TempWorktree::add(repo_dir, base.path.join(format!("worker-{}", i))))
+            .collect::<Result<Vec<_>>>()?;
+        Ok(Self {
+            worktrees,
+            _base: base,
+        })
+    }
+}
+
+/// The captured result of one invocation of the user's command
+#[derive(Debug)]
+struct CommandOutput {
+    outcome: Outcome,
+    duration: Duration,
+    /// How many times the command was run, more than one if it was retried
+    attempts: u32,
+    stdout: Vec<u8>,
+    stderr: Vec<u8>,
+}
+
+/// How often a running command is checked for completion
+const POLL_INTERVAL: Duration = Duration::from_millis(10);
+
+fn read_in_background<R>(pipe: Option<R>) -> JoinHandle<Vec<u8>>
+where
+    R: Read + Send + 'static,
+{
+    std::thread::spawn(move || {
+        let mut buf = Vec::new();
+        if let Some(mut pipe) = pipe {
+            let _ = pipe.read_to_end(&mut buf);
+        }
+        buf
+    })
+}
+
+/// Kill the command along with any processes it started
+fn kill_process_group(child: &mut Child) {
+    #[cfg(unix)]
+    unsafe {
+        libc::kill(-(child.id() as libc::pid_t), libc::SIGKILL);
+    }
+    #[cfg(not(unix))]
+    let _ = child.kill();
+}
+
+/// Search PATH for `program` the way spawning it would, returning None if it
+/// cannot be found.
+///
+/// Names containing a path separator are not searched for and are returned
+/// as they are, since they are resolved against each commit's checkout.
+fn find_program(program: &str) -> Option<PathBuf> {
+    let path = Path::new(program);
+    if path.components().count() > 1 {
+        return Some(path.to_path_buf());
+    }
+    let extensions = if cfg!(windows) {
+        // the name may already have its extension
+        let pathext =
+            std::env::var("PATHEXT").unwrap_or_else(|_| ".COM;.EXE;.BAT;.CMD".to_string());
+        std::iter::once(String::new())
+            .chain(pathext.split(';').map(|extension| extension.to_string()))
+            .collect()
+    } else {
+        vec![String::new()]
+    };
+    let search = std::env::var_os("PATH")?;
+    std::env::split_paths(&search)
+        .flat_map(|dir| {
+            extensions
+                .iter()
+                .map(move |extension| dir.join(format!("{}{}", program, extension)))
+        })
+        .find(|candidate| is_executable(candidate))
+}
+
+#[cfg(unix)]
+fn is_executable(path: &Path) -> bool {
+    use std::os::unix::fs::PermissionsExt;
+    std::fs::metadata(path)
+        .map(|metadata| metadata.is_file() && metadata.permissions().mode() & 0o111 != 0)
+        .unwrap_or(false)
+}
+
+#[cfg(not(unix))]
+fn is_executable(path: &Path) -> bool {
+    path.is_file()
+}
+
+/// A command which runs `script` through the platform's shell.
+///
+/// cmd expands `%VAR%` before parsing the line, so delayed expansion is
+/// turned on for the `!VAR!` references left by `substitute_for_shell`.
+fn shell_command(script: &str) -> Command {
+    let mut cmd = if cfg!(windows) {
+        Command::new("cmd")
+    } else {
+        Command::new("sh")
+    };
+    if cfg!(windows) {
+        cmd.args(&["/V:ON", "/C", script]);
+    } else {
+        cmd.args(&["-c", script]);
+    }
+    cmd
+}
+
+/// Build the user's command for one commit, substituting its placeholders
+fn build_command(config: &RunConfig, info: &CommitInfo) -> Command {
+    if config.shell {
+        let script = substitute_for_shell(&config.command.join(" "), info);
+        tracing::info!(%script, "running user specified command through the shell");
+        shell_command(&script)
+    } else {
+        let argv = config
+            .command
+            .iter()
+            .map(|arg| substitute(arg, info))
+            .collect::<Vec<_>>();
+        tracing::info!(?argv, "running user specified command");
+        let mut cmd = Command::new(&argv[0]);
+        cmd.args(&argv[1..]);
+        cmd
+    }
+}
+
+/// Run the command on one commit, along with the --skip-if, --before,
+/// --on-failure and --after commands if they were given.
+///
+/// A failing --skip-if or --before command skips the command, and
+/// --on-failure runs as soon as the command has failed. The --after command runs
+/// whatever the command's outcome, a failed --before included, unless the run
+/// is about to stop because of it.
+fn run_command(dir: &Path, config: &RunConfig, info: &CommitInfo) -> Result<CommandOutput> {
+    if let Some(skip_if) = &config.skip_if {
+        let script = substitute_for_shell(skip_if, info);
+        tracing::info!(%script, "running --skip-if command");
+        let output = run_process(shell_command(&script), dir, config, info)
+            .wrap_err("running --skip-if command")?;
+        match output.outcome {
+            Outcome::Exited(0) => {}
+            Outcome::Exited(_) => {
+                return Ok(CommandOutput {
+                    outcome: Outcome::Skipped,
+                    ..output
+                })
+            }
+            _ => return Ok(output),
+        }
+    }
+
+    if let Some(before) = &config.before {
+        let script = substitute_for_shell(before, info);
+        tracing::info!(%script, "running --before command");
+        let output = run_process(shell_command(&script), dir, config, info)
+            .wrap_err("running --before command")?;
+        match output.outcome {
+            Outcome::Exited(0) => {}
+            Outcome::Exited(code) => {
+                // the --before command may have half set the commit up, so let --after undo it
+                run_after(dir, config, info, config.stop_on_failure)?;
+                return Ok(CommandOutput {
+                    outcome: Outcome::SetupFailed(code),
+                    ..output
+                });
+            }
+            _ => return Ok(output),
+        }
+    }
+
+    let mut output = run_process(build_command(config, info), dir, config, info)?;
+    let mut elapsed = output.duration;
+    let mut attempts = 1;
+    let failed = |outcome| matches!(outcome, Outcome::Exited(code) if !exit_passed(code, config.invert_exit));
+    while failed(output.outcome) && attempts <= config.retries {
+        tracing::debug!(attempts, "command failed, retrying");
+        if !sleep_unless_interrupted(config.retry_delay, &config.interrupt) {
+            break;
+        }
+        output = run_process(build_command(config, info), dir, config, info)?;
+        elapsed += output.duration;
+        attempts += 1;
+    }
+    // the reported output is from the last attempt, but the time covers them all
+    output.duration = elapsed;
+    output.attempts = attempts;
+
+    if let Some(on_failure) = &config.on_failure {
+        let exit = match output.outcome {
+            Outcome::Exited(code) if failed(output.outcome) => Some(code.to_string()),
+            Outcome::Exited(_) | Outcome::Interrupted => None,
+            // there is no exit code to report for a killed command
+            _ => Some(String::new()),
+        };
+        if let Some(exit) = exit {
+            let script = substitute_for_shell(on_failure, info);
+            tracing::info!(%script, "running --on-failure command");
+            let mut cmd = shell_command(&script);
+            cmd.env("GIT_REV_EXIT", exit);
+            let hook =
+                run_process(cmd, dir, config, info).wrap_err("running --on-failure command")?;
+            warn_hook_failed("--on-failure", &hook, info, config);
+        }
+    }
+
+    let stopping = match output.outcome {
+        Outcome::Exited(_) if !failed(output.outcome) => false,
+        Outcome::Interrupted => true,
+        _ => config.stop_on_failure,
+    };
+    run_after(dir, config, info, stopping)?;
+
+    Ok(output)
+}
+
+/// Run the --after command, if there is one and the run is not stopping
+fn run_after(dir: &Path, config: &RunConfig, info: &CommitInfo, stopping: bool) -> Result<()> {
+    if let Some(after) = &config.after {
+        if !stopping {
+            let script = substitute_for_shell(after, info);
+            tracing::info!(%script, "running --after command");
+            let hook = run_process(shell_command(&script), dir, config, info)
+                .wrap_err("running --after command")?;
+            warn_hook_failed("--after", &hook, info, config);
+        }
+    }
+    Ok(())
+}
+
+/// Files to copy out of the working tree after the command has run on a
+/// commit, as given by `--collect`
+struct Collect {
+    globs: globset::GlobSet,
+    /// Each commit's files go under `<dir>/<short hash>/`
+    dir: PathBuf,
+    passing_only: bool,
+}
+
+impl Collect {
+    fn new(patterns: &[String], dir: PathBuf, passing_only: bool) -> Result<Self> {
+        let mut builder = globset::GlobSetBuilder::new();
+        for pattern in patterns {
+            // like a shell, * stops at directory separators and ** crosses them
+            let glob = globset::GlobBuilder::new(pattern)
+                .literal_separator(true)
+                .build()
+                .wrap_err_with(|| format!("invalid --collect pattern {}", pattern))?;
+            builder.add(glob);
+        }
+        std::fs::create_dir_all(&dir)
+            .wrap_err_with(|| format!("creating collect directory {}", dir.display()))?;
+        // canonical, so that it can be recognised if it is inside the working tree
+        let dir = dir
+            .canonicalize()
+            .wrap_err_with(|| format!("resolving collect directory {}", dir.display()))?;
+        Ok(Self {
+            globs: builder.build().wrap_err("building --collect patterns")?,
+            dir,
+            passing_only,
+        })
+    }
+
+    /// Copy the matching files under `workdir`, keeping their relative paths.
+    /// Nothing is created if no file matches
+    fn copy(&self, workdir: &Path, info: &CommitInfo) -> Result<()> {
+        let dest = self.dir.join(&info.short);
+        let mut pending = vec![workdir.to_path_buf()];
+        while let Some(dir) = pending.pop() {
+            let entries = std::fs::read_dir(&dir)
+                .wrap_err_with(|| format!("reading directory {}", dir.display()))?;
+            for entry in entries {
+                let entry = entry?;
+                let path = entry.path();
+                let relative = path.strip_prefix(workdir).expect("path is under workdir");
+                if relative == Path::new(".git") {
+                    continue;
+                }
+                let file_type = entry.file_type()?;
+                if file_type.is_dir() {
+                    // never collect earlier commits' artifacts
+                    if path.canonicalize().ok().as_ref() != Some(&self.dir) {
+                        pending.push(path);
+                    }
+                } else if self.globs.is_match(relative) {
+                    let target = dest.join(relative);
+                    if let Some(parent) = target.parent() {
+                        std::fs::create_dir_all(parent)
+                            .wrap_err_with(|| format!("creating directory {}", parent.display()))?;
+                    }
+                    tracing::trace!(path = %relative.display(), "collecting file");
+                    std::fs::copy(&path, &target)
+                        .wrap_err_with(|| format!("copying {}", relative.display()))?;
+                }
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Report a failed --after or --on-failure command, which does not change
+/// the commit's result
+fn warn_hook_failed(flag: &str, hook: &CommandOutput, info: &CommitInfo, config: &RunConfig) {
+    if hook.outcome == Outcome::Exited(0) {
+        return;
+    }
+    let mut message = format!("{} command failed on commit {}", flag, info.short);
+    let stderr = String::from_utf8_lossy(&hook.stderr);
+    if !stderr.trim().is_empty() {
+        message = format!("{}\n{}", message, stderr.trim());
+    }
+    config.log(Verbosity::Normal, message);
+}
+
+/// Wait for `delay`, returning false straight away if the run is interrupted
+fn sleep_unless_interrupted(delay: Duration, interrupt: &Interrupt) -> bool {
+    let deadline = Instant::now() + delay;
+    while Instant::now() < deadline {
+        if interrupt.is_set() {
+            return false;
+        }
+        std::thread::sleep(POLL_INTERVAL.min(deadline - Instant::now()));
+    }
+    !interrupt.is_set()
+}
+
+/// Spawn `cmd` in `dir` with the commit's environment, and wait for it to
+/// exit, time out or be interrupted
+fn run_process(
+    mut cmd: Command,
+    dir: &Path,
+    config: &RunConfig,
+    info: &CommitInfo,
+) -> Result<CommandOutput> {
+    cmd.current_dir(dir)
+        .envs(info.env_vars())
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped());
+    #[cfg(unix)]
+    {
+        use std::os::unix::process::CommandExt;
+        // give the command its own process group so that killing it on a timeout or
+        // interrupt takes its children with it
+        cmd.process_group(0);
+    }
+
+    let argv = std::iter::once(cmd.get_program())
+        .chain(cmd.get_args())
+        .map(|arg| arg.to_string_lossy())
+        .collect::<Vec<_>>();
+    config.log(
+        Verbosity::Verbose,
+        format_args!("Running {:?} in {}", argv, dir.display()),
+    );
+
+    let started = Instant::now();
+    let mut child = cmd.spawn().wrap_err("spawning user command")?;
+    let stdout = read_in_background(child.stdout.take());
+    let stderr = read_in_background(child.stderr.take());
+
+    let deadline = config.timeout.map(|timeout| Instant::now() + timeout);
+    let outcome = loop {
+        if let Some(status) = child.try_wait().wrap_err("waiting for user command")? {
+            break Outcome::Exited(status.code().unwrap_or(1));
+        }
+        if config.interrupt.is_set() {
+            tracing::debug!("interrupted, killing command");
+            kill_process_group(&mut child);
+            child.wait().wrap_err("waiting for killed command")?;
+            break Outcome::Interrupted;
+        }
+        if deadline.map_or(false, |deadline| Instant::now() >= deadline) {
+            tracing::debug!("command timed out");
+            kill_process_group(&mut child);
+            child.wait().wrap_err("waiting for killed command")?;
+            break Outcome::TimedOut;
+        }
+        std::thread::sleep(POLL_INTERVAL);
+    };
+
+    Ok(CommandOutput {
+        outcome,
+        duration: started.elapsed(),
+        attempts: 1,
+        stdout: stdout.join().unwrap_or_default(),
+        stderr: stderr.join().unwrap_or_default(),
+    })
+}
+
+/// Print the result of a single commit's run.
+///
+/// The output streams are locked for the duration so that the reports of
+/// concurrent workers never interleave.
+fn report(info: &CommitInfo, output: CommandOutput, config: &RunConfig) -> CommitResult {
+    let oid = info.oid;
+    let result = CommitResult {
+        oid,
+        subject: info.subject.clone(),
+        date: info.date.clone(),
+        outcome: output.outcome,
+        duration: output.duration,
+        attempts: output.attempts,
+        inverted: config.invert_exit,
+        tags: info.tags.split_whitespace().map(str::to_string).collect(),
+        stdout: String::from_utf8_lossy(&output.stdout).into_owned(),
+        stderr: String::from_utf8_lossy(&output.stderr).into_owned(),
+    };
+
+    match result.outcome {
+        Outcome::Exited(code) if result.passed() => {
+            tracing::trace!(stdout = %result.stdout, %code, "successful exit code")
+        }
+        Outcome::Exited(code) => {
+            tracing::trace!(stderr = %result.stderr, %code, "failed exit code")
+        }
+        Outcome::SetupFailed(code) => {
+            tracing::trace!(stderr = %result.stderr, %code, "setup failed")
+        }
+        Outcome::TimedOut => tracing::trace!("timed out"),
+        Outcome::Interrupted => tracing::trace!("interrupted"),
+        Outcome::Skipped => tracing::trace!("skipped"),
+    }
+
+    if config.format != Format::Human {
+        return result;
+    }
+
+    let mut out = config.out.lock();
+    let mut err = config.err.lock();
+    if let Some(progress) = &config.progress {
+        progress.clear(&mut *err);
+    }
+
+    let mut notes = Vec::new();
+    if result.attempts > 1 {
+        notes.push(format!("after {} attempts", result.attempts));
+    }
+    if config.timing {
+        notes.push(format!("{:.2?}", result.duration));
+    }
+    let suffix = if notes.is_empty() {
+        String::new()
+    } else {
+        format!(" ({})", notes.join(", "))
+    };
+    // each line is coloured for the stream it goes to
+    let line = |color: bool, status: &str| {
+        format!(
+            "Commit {} {}{}",
+            paint(color, YELLOW, oid),
+            paint(color, result.color(), status),
+            suffix
+        )
+    };
+    match result.outcome {
+        Outcome::Exited(code) if result.passed() => {
+            let status = if result.inverted {
+                format!("successful, exited with code {}", code)
+            } else {
+                "successful".to_string()
+            };
+            if config.verbosity >= Verbosity::Normal {
+                let _ = writeln!(out, "{}", line(config.color, &status));
+            }
+        }
+        Outcome::Exited(code) => {
+            let status = if result.inverted {
+                "failed, exited with code 0 under --invert-exit".to_string()
+            } else {
+                format!("failed with exit code {}", code)
+            };
+            let _ = writeln!(err, "{}", line(config.color_stderr, &status));
+        }
+        Outcome::SetupFailed(code) => {
+            let status = format!("skipped, --before command failed with exit code {}", code);
+            let _ = writeln!(err, "{}", line(config.color_stderr, &status));
+        }
+        Outcome::TimedOut => {
+            let _ = writeln!(err, "{}", line(config.color_stderr, "timed out"));
+        }
+        Outcome::Interrupted => {
+            let _ = writeln!(err, "{}", line(config.color_stderr, "interrupted"));
+        }
+        Outcome::Skipped => {
+            if config.verbosity >= Verbosity::Normal {
+                let _ = writeln!(out, "{}", line(config.color, "skipped by --skip-if"));
+            }
+        }
+    }
+
+    if result.failed() {
+        match &config.log_dir {
+            Some(log_dir) => {
+                let path = log_dir.join(format!("{}.err", info.short));
+                let _ = writeln!(err, "See {} for the command's output", path.display());
+            }
+            None => {
+                let stderr = result.stderr.trim();
+                if !stderr.is_empty() {
+                    let _ = writeln!(err, "{}", stderr);
+                }
+            }
+        }
+    }
+
+    result
+}
+
+/// Save the command's output streams under `log_dir`.
+///
+/// Both files are always written, even when empty, so that every commit that
+/// ran has a matching pair.
+fn write_logs(log_dir: &Path, info: &CommitInfo, output: &CommandOutput) -> Result<()> {
+    for (extension, contents) in [("out", &output.stdout), ("err", &output.stderr)] {
+        let path = log_dir.join(format!("{}.{}", info.short, extension));
+        std::fs::write(&path, contents)
+            .wrap_err_with(|| format!("writing log file {}", path.display()))?;
+    }
+    Ok(())
+}
+
+/// Print the status of every commit that was run, along with how long the
+/// command took when `timing` is set
+fn print_summary(
+    out: &mut dyn Write,
+    results: &[CommitResult],
+    timing: bool,
+    color: bool,
+) -> Result<()> {
+    writeln!(out, "Summary:")?;
+    for result in results {
+        let hash = paint(color, YELLOW, short_id(result.oid));
+        let status = paint(color, result.color(), result.status());
+        write!(out, "  {}", hash)?;
+        if !result.tags.is_empty() {
+            write!(out, " ({})", result.tags.join(", "))?;
+        }
+        write!(out, " {}", status)?;
+        if timing {
+            write!(out, " {:.2?}", result.duration)?;
+        }
+        if result.attempts > 1 {
+            write!(out, " ({} attempts)", result.attempts)?;
+        }
+        writeln!(out)?;
+    }
+
+    if timing && !results.is_empty() {
+        let durations = results.iter().map(|result| result.duration);
+        let total: Duration = durations.clone().sum();
+        let min = durations.clone().min().unwrap_or_default();
+        let max = durations.max().unwrap_or_default();
+        let mean = total / results.len() as u32;
+        writeln!(
+            out,
+            "Total {:.2?} (min {:.2?}, max {:.2?}, mean {:.2?})",
+            total, min, max, mean
+        )?;
+    }
+    Ok(())
+}
+
+/// A commit whose result differs from the commit run before it
+#[derive(Debug)]
+struct Transition<'a> {
+    result: &'a CommitResult,
+    /// The commit it is compared with
+    previous: &'a CommitResult,
+}
+
+impl Transition<'_> {
+    fn label(&self) -> &'static str {
+        if self.result.passed() {
+            "first PASS again"
+        } else {
+            "first FAIL"
+        }
+    }
+}
+
+/// Find the commits where the command went from passing to failing or back,
+/// in the order they were run.
+///
+/// Skipped and interrupted commits say nothing about the commit, so each
+/// result is compared with the last one that ran to completion.
+fn transitions(results: &[CommitResult]) -> Vec<Transition<'_>> {
+    let mut transitions = Vec::new();
+    let mut previous: Option<&CommitResult> = None;
+    for result in results {
+        if matches!(result.outcome, Outcome::Skipped | Outcome::Interrupted) {
+            continue;
+        }
+        if let Some(previous) = previous {
+            if previous.passed() != result.passed() {
+                transitions.push(Transition { result, previous });
+            }
+        }
+        previous = Some(result);
+    }
+    transitions
+}
+
+/// Print the commits where the result flipped, if there are any
+fn print_transitions(out: &mut dyn Write, transitions: &[Transition], color: bool) -> Result<()> {
+    if transitions.is_empty() {
+        return Ok(());
+    }
+    writeln!(out, "Transitions:")?;
+    for transition in transitions {
+        let hash = paint(color, YELLOW, short_id(transition.result.oid));
+        let label = paint(color, transition.result.color(), transition.label());
+        writeln!(out, "  {} {} {}", hash, label, transition.result.subject)?;
+    }
+    Ok(())
+}
+
+/// Print a single line counting the passes, failures and skips, for `--quiet`
+fn print_counts(out: &mut dyn Write, results: &[CommitResult]) -> Result<()> {
+    let passed = results.iter().filter(|result| result.passed()).count();
+    let failed = results.iter().filter(|result| result.failed()).count();
+    let skipped = results.len() - passed - failed;
+    writeln!(
+        out,
+        "{} passed, {} failed, {} skipped",
+        passed, failed, skipped
+    )?;
+    Ok(())
+}
+
+/// A commit's result as written by `--format json`
+#[derive(Debug, Serialize)]
+struct JsonResult<'a> {
+    hash: String,
+    subject: &'a str,
+    status: &'static str,
+    exit_code: Option<i32>,
+    duration_ms: u128,
+    attempts: u32,
+    tags: &'a [String],
+    stdout: &'a str,
+    stderr: &'a str,
+    /// Left out unless the result differs from the commit run before it
+    #[serde(skip_serializing_if = "Option::is_none")]
+    transition: Option<JsonTransition>,
+}
+
+impl<'a> From<&'a CommitResult> for JsonResult<'a> {
+    fn from(result: &'a CommitResult) -> Self {
+        Self {
+            hash: result.oid.to_string(),
+            subject: &result.subject,
+            status: result.status(),
+            exit_code: result.exit_code(),
+            duration_ms: result.duration.as_millis(),
+            attempts: result.attempts,
+            tags: &result.tags,
+            stdout: &result.stdout,
+            stderr: &result.stderr,
+            transition: None,
+        }
+    }
+}
+
+/// A transition as written by `--format json`, on the commit whose result
+/// flipped
+#[derive(Debug, Serialize)]
+struct JsonTransition {
+    label: &'static str,
+    /// The commit it differs from
+    previous: String,
+}
+
+impl From<&Transition<'_>> for JsonTransition {
+    fn from(transition: &Transition<'_>) -> Self {
+        Self {
+            label: transition.label(),
+            previous: transition.previous.oid.to_string(),
+        }
+    }
+}
+
+fn print_json(
+    out: &mut dyn Write,
+    results: &[CommitResult],
+    transitions: &[Transition],
+) -> Result<()> {
+    let json: Vec<_> = results
+        .iter()
+        .map(|result| JsonResult {
+            transition: transitions
+                .iter()
+                .find(|transition| transition.result.oid == result.oid)
+                .map(JsonTransition::from),
+            ..JsonResult::from(result)
+        })
+        .collect();
+    serde_json::to_writer_pretty(&mut *out, &json).wrap_err("writing json")?;
+    writeln!(out)?;
+    Ok(())
+}
+
+/// Quote a CSV field if it needs it, following RFC 4180
+fn csv_field(value: &str) -> String {
+    if value.contains(&[',', '"', '\r', '\n'][..]) {
+        format!("\"{}\"", value.replace('"', "\"\""))
+    } else {
+        value.to_string()
+    }
+}
+
+fn print_csv(out: &mut dyn Write, results: &[CommitResult]) -> Result<()> {
+    // RFC 4180 lines end in CRLF
+    write!(
+        out,
+        "hash,short,author_date,subject,exit_code,duration_ms,status\r\n"
+    )?;
+    for result in results {
+        let fields = [
+            result.oid.to_string(),
+            short_id(result.oid),
+            result.date.clone(),
+            result.subject.clone(),
+            result
+                .exit_code()
+                .map_or_else(String::new, |code| code.to_string()),
+            result.duration.as_millis().to_string(),
+            result.status().to_string(),
+        ];
+        let row = fields
+            .iter()
+            .map(|field| csv_field(field))
+            .collect::<Vec<_>>();
+        write!(out, "{}\r\n", row.join(","))?;
+    }
+    Ok(())
+}
+
+/// Write the summary of `results` in the configured format, along with the
+/// commits where the result flipped.
+///
+/// A bisection runs commits out of order, so it has no `transitions`.
+fn write_results(
+    out: &mut dyn Write,
+    results: &[CommitResult],
+    transitions: &[Transition],
+    config: &RunConfig,
+) -> Result<()> {
+    match config.format {
+        Format::Human if config.verbosity == Verbosity::Quiet => print_counts(out, results),
+        Format::Human => {
+            print_summary(out, results, config.timing, config.color)?;
+            print_transitions(out, transitions, config.color)
+        }
+        Format::Json => print_json(out, results, transitions),
+        Format::Csv => print_csv(out, results),
+    }
+}
+
+/// Name of the file, inside the git directory, which records progress for `--continue`
+const STATE_FILE: &str = "run-on-revisions-state.json";
+
+/// Progress of a run, as saved in the state file
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct RunState {
+    /// The resolved range, as `<start hash>..<end hash>`
+    range: String,
+    completed: Vec<CompletedCommit>,
+}
+
+/// A commit which the command finished on
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct CompletedCommit {
+    hash: String,
+    subject: String,
+    date: String,
+    status: String,
+    /// None if the command timed out
+    exit_code: Option<i32>,
+    duration_ms: u64,
+    attempts: u32,
+    /// Missing from state files written before tags were recorded
+    #[serde(default)]
+    tags: Vec<String>,
+}
+
+impl CompletedCommit {
+    fn to_result(&self) -> Result<CommitResult> {
+        let oid = git2::Oid::from_str(&self.hash)
+            .wrap_err_with(|| format!("invalid hash {} in state file", self.hash))?;
+        Ok(CommitResult {
+            oid,
+            subject: self.subject.clone(),
+            date: self.date.clone(),
+            outcome: match (self.status.as_str(), self.exit_code) {
+                ("SKIPPED", _) => Outcome::Skipped,
+                ("SETUP_FAILED", Some(code)) => Outcome::SetupFailed(code),
+                (_, Some(code)) => Outcome::Exited(code),
+                (_, None) => Outcome::TimedOut,
+            },
+            duration: Duration::from_millis(self.duration_ms),
+            attempts: self.attempts,
+            // recover the interpretation the status was recorded under
+            inverted: match self.exit_code {
+                Some(code) => (self.status == "PASS") != (code == 0),
+                None => false,
+            },
+            tags: self.tags.clone(),
+            stdout: String::new(),
+            stderr: String::new(),
+        })
+    }
+}
+
+/// The state file for the current run, rewritten after every commit so that
+/// an interrupted run can be picked up again with `--continue`
+#[derive(Debug)]
+struct StateFile {
+    path: PathBuf,
+    state: Mutex<RunState>,
+}
+
+impl StateFile {
+    /// Open the state file for `range`. Previous progress is only kept when
+    /// resuming, and only if it was recorded for the same range
+    fn open(repo: &Repository, range: String, resume: bool) -> Result<Self> {
+        let path = repo.path().join(STATE_FILE);
+        let fresh = RunState {
+            range: range.clone(),
+            completed: Vec::new(),
+        };
+        let state = if resume {
+            match std::fs::read(&path) {
+                Ok(bytes) => {
+                    let state: RunState = serde_json::from_slice(&bytes)
+                        .wrap_err_with(|| format!("reading state file {}", path.display()))?;
+                    if state.range == range {
+                        state
+                    } else {
+                        tracing::info!(previous = %state.range, "state file is for another range, starting afresh");
+                        fresh
+                    }
+                }
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => fresh,
+                Err(e) => {
+                    return Err(e)
+                        .wrap_err_with(|| format!("reading state file {}", path.display()))
+                }
+            }
+        } else {
+            fresh
+        };
+        Ok(Self {
+            path,
+            state: Mutex::new(state),
+        })
+    }
+
+    /// Results from the previous run, in the order they were recorded
+    fn completed(&self) -> Result<Vec<CommitResult>> {
+        let state = self.state.lock().unwrap();
+        state
+            .completed
+            .iter()
+            .map(CompletedCommit::to_result)
+            .collect()
+    }
+
+    /// Record that the command finished on a commit and save the state.
+    /// Interrupted commits are left out so that they are run again on resume
+    fn record(&self, result: &CommitResult) -> Result<()> {
+        if result.outcome == Outcome::Interrupted {
+            return Ok(());
+        }
+        let mut state = self.state.lock().unwrap();
+        state.completed.push(CompletedCommit {
+            hash: result.oid.to_string(),
+            subject: result.subject.clone(),
+            date: result.date.clone(),
+            status: result.status().to_string(),
+            exit_code: result.exit_code(),
+            duration_ms: result.duration.as_millis() as u64,
+            attempts: result.attempts,
+            tags: result.tags.clone(),
+        });
+        // write then rename, so an interruption never leaves a truncated file
+        let tmp = self.path.with_extension("json.tmp");
+        let bytes = serde_json::to_vec(&*state).wrap_err("serialising state")?;
+        std::fs::write(&tmp, bytes)
+            .wrap_err_with(|| format!("writing state file {}", tmp.display()))?;
+        std::fs::rename(&tmp, &self.path)
+            .wrap_err_with(|| format!("writing state file {}", self.path.display()))?;
+        Ok(())
+    }
+}
+
+/// Check out a single commit in `dir` and run the command on it.
+///
+/// With `--no-checkout` the commit's tree is exported to a temporary
+/// directory and the command runs there instead, leaving `dir` untouched.
+fn process_commit(
+    repo: &Repository,
+    dir: &Path,
+    oid: git2::Oid,
+    config: &RunConfig,
+) -> Result<CommitResult> {
+    let export = if config.no_checkout {
+        tracing::trace!("exporting commit");
+        config.log(Verbosity::Verbose, format_args!("Exporting {}", oid));
+        let export = TempDir::new(&short_id(oid))?;
+        export_tree(repo, oid, &export.path)
+            .wrap_err_with(|| format!("exporting commit {}", oid))?;
+        Some(export)
+    } else {
+        tracing::trace!("checking out commit");
+        config.log(Verbosity::Verbose, format_args!("Checking out {}", oid));
+        checkout(repo, oid, config.submodules)
+            .wrap_err_with(|| format!("checking out commit {}", oid))?;
+        None
+    };
+    let dir = export.as_ref().map_or(dir, |export| export.path.as_path());
+
+    let span = tracing::debug_span!("commit", sha = ?oid, command = ?config.command);
+    let _enter = span.enter();
+
+    let mut info = CommitInfo::load(repo, oid)?;
+    if let Some(names) = config.tags.get(&oid) {
+        info.tags = names.join(" ");
+    }
+    if let Some(progress) = &config.progress {
+        progress.start(&info, &mut *config.err.lock());
+    }
+    let env = info
+        .env_vars()
+        .iter()
+        .map(|(name, value)| format!("  {}={}", name, value))
+        .collect::<Vec<_>>();
+    config.log(Verbosity::Verbose, env.join("\n"));
+    let output = run_command(dir, config, &info)?;
+    if let Some(progress) = &config.progress {
+        progress.finish(output.duration);
+    }
+    if let Some(collect) = &config.collect {
+        let ran = matches!(output.outcome, Outcome::Exited(_) | Outcome::TimedOut);
+        let passed = matches!(output.outcome, Outcome::Exited(code) if exit_passed(code, config.invert_exit));
+        if ran && (passed || !collect.passing_only) {
+            collect
+                .copy(dir, &info)
+                .wrap_err_with(|| format!("collecting artifacts from commit {}", oid))?;
+        }
+    }
+    if let Some(log_dir) = &config.log_dir {
+        write_logs(log_dir, &info, &output)?;
+    }
+    let result = report(&info, output, config);
+    if let Some(state) = &config.state {
+        state.record(&result)?;
+    }
+    if let Some(on_result) = &config.on_result {
+        on_result(&result);
+    }
+    Ok(result)
+}
+
+/// Check that the working tree can be used for checkouts, stashing changes if
+/// asked to, and arrange for HEAD and the stash to be restored afterwards.
+///
+/// Every one of `commits` is checked for untracked files it would overwrite
+/// up front, so that the run does not stop part way through when it reaches
+/// one.
+///
+/// Exporting trees never touches the working tree, so with `--no-checkout`
+/// there is nothing to protect.
+fn protect_head<'r>(
+    repo: &'r Repository,
+    commits: &[git2::Oid],
+    config: &'r RunConfig,
+) -> Result<Option<RestoreHead<'r>>> {
+    if config.no_checkout {
+        return Ok(None);
+    }
+
+    if !config.force_checkout {
+        let conflicts = untracked_conflicts(repo, commits)?;
+        if !conflicts.is_empty() {
+            let lines: Vec<String> = conflicts
+                .iter()
+                .map(|(path, oid)| format!("{} (tracked in {})", path, short_id(*oid)))
+                .collect();
+            eyre::bail!(
+                "checking out these revisions would overwrite untracked files, move them or pass --force-checkout:\n    {}",
+                lines.join("\n    ")
+            );
+        }
+    }
+
+    let dirty = dirty_files(repo)?;
+    if !dirty.is_empty() && !config.stash {
+        eyre::bail!(
+            "working tree has uncommitted changes, commit them or pass --stash:\n    {}",
+            dirty.join("\n    ")
+        );
+    }
+
+    let mut restore = RestoreHead::record(repo, config)?;
+    if !dirty.is_empty() {
+        let workdir = repo
+            .workdir()
+            .ok_or_else(|| eyre::eyre!("repository has no working tree"))?;
+        tracing::debug!(?dirty, "stashing uncommitted changes");
+        let args = [
+            "stash",
+            "push",
+            "--quiet",
+            "--message",
+            "run-command-on-git-revisions",
+        ];
+        if let Err(e) = git(workdir, &args) {
+            // HEAD has not moved, and restoring it would discard the unstashed changes
+            restore.original = None;
+            return Err(e.wrap_err("stashing uncommitted changes"));
+        }
+        restore.stashed = true;
+    }
+    Ok(Some(restore))
+}
+
+/// Run the command on each commit in place, restoring the original HEAD afterwards
+fn run_serial(
+    repo: &Repository,
+    workdir: &Path,
+    commits: Vec<git2::Oid>,
+    config: &RunConfig,
+) -> Result<Vec<CommitResult>> {
+    let restore = protect_head(repo, &commits, config)?;
+
+    let mut results = Vec::with_capacity(commits.len());
+    for oid in commits {
+        if config.interrupt.is_set() {
+            tracing::debug!("interrupted, not starting any more commits");
+            break;
+        }
+        if config.out_of_time() {
+            tracing::debug!("out of time, not starting any more commits");
+            break;
+        }
+
+        let result = process_commit(repo, workdir, oid, config)?;
+        let failed = result.failed();
+        results.push(result);
+
+        if failed && config.stop_on_failure {
+            tracing::debug!("stopping at first failure");
+            break;
+        }
+    }
+
+    if let Some(restore) = restore {
+        restore.restore()?;
+    }
+    Ok(results)
+}
+
+/// The result of a `--bisect` run
+#[derive(Debug)]
+struct Bisection {
+    /// The commits that were tested, in the order they were run
+    tested: Vec<CommitResult>,
+    /// None when the bisection was interrupted or ran out of time first
+    first_bad: Option<git2::Oid>,
+    /// Skipped commits just before `first_bad`, any of which may be the real
+    /// first failure
+    undecided: Vec<git2::Oid>,
+}
+
+/// Binary search `commits`, ordered oldest first, for the first commit where
+/// the command fails, assuming it passes on the first commit and fails on the last
+fn run_bisect(
+    repo: &Repository,
+    workdir: &Path,
+    commits: &[git2::Oid],
+    config: &RunConfig,
+) -> Result<Bisection> {
+    let (first, last) = match commits {
+        [first, .., last] => (*first, *last),
+        _ => eyre::bail!("bisecting needs at least two commits in the range"),
+    };
+
+    let restore = protect_head(repo, commits, config)?;
+    let mut tested = Vec::new();
+
+    // None when --skip-if decided the commit was not worth testing
+    let mut test = |oid| -> Result<Option<bool>> {
+        let result = process_commit(repo, workdir, oid, config)?;
+        let passed = match result.outcome {
+            Outcome::Skipped => None,
+            _ => Some(result.passed()),
+        };
+        tested.push(result);
+        Ok(passed)
+    };
+    // a stopped bisection reports the commits it tested so far
+    let stopped = || config.interrupt.is_set() || config.out_of_time();
+
+    let found = 'search: {
+        let passed = test(first)?;
+        if stopped() {
+            break 'search None;
+        }
+        match passed {
+            Some(true) => {}
+            Some(false) => eyre::bail!(
+                "the command already fails on the start commit {}, so there is no good commit to bisect from",
+                short_id(first)
+            ),
+            None => eyre::bail!("--skip-if skipped the start commit {}", short_id(first)),
+        }
+        let passed = test(last)?;
+        if stopped() {
+            break 'search None;
+        }
+        match passed {
+            Some(false) => {}
+            Some(true) => eyre::bail!(
+                "the command passes on the end commit {}, so no failing commit was found",
+                short_id(last)
+            ),
+            None => eyre::bail!("--skip-if skipped the end commit {}", short_id(last)),
+        }
+
+        // invariant: the command passes at `good` and fails at `bad`, and every
+        // skipped commit lies between them
+        let (mut good, mut bad) = (0, commits.len() - 1);
+        let mut skipped = HashSet::new();
+        loop {
+            // like git bisect skip, try the untested commit nearest the middle
+            let mid = good + (bad - good) / 2;
+            let next = (good + 1..bad)
+                .filter(|index| !skipped.contains(index))
+                .min_by_key(|&index| (index as isize - mid as isize).abs());
+            let index = match next {
+                Some(index) => index,
+                None => break,
+            };
+            let passed = test(commits[index])?;
+            if stopped() {
+                break 'search None;
+            }
+            match passed {
+                Some(true) => {
+                    good = index;
+                    skipped.retain(|&skip| skip > good);
+                }
+                Some(false) => {
+                    bad = index;
+                    skipped.retain(|&skip| skip < bad);
+                }
+                None => {
+                    skipped.insert(index);
+                }
+            }
+        }
+        Some((good, bad))
+    };
+
+    if let Some(restore) = restore {
+        restore.restore()?;
+    }
+    Ok(match found {
+        Some((good, bad)) => Bisection {
+            tested,
+            first_bad: Some(commits[bad]),
+            undecided: commits[good + 1..bad].to_vec(),
+        },
+        None => Bisection {
+            tested,
+            first_bad: None,
+            undecided: Vec::new(),
+        },
+    })
+}
+
+/// Work shared between the parallel workers
+struct SharedQueue {
+    commits: Mutex<std::iter::Enumerate<std::vec::IntoIter<git2::Oid>>>,
+    results: Mutex<Vec<(usize, CommitResult)>>,
+    stop: AtomicBool,
+}
+
+/// Take commits from the queue until it is empty or the run is stopped. An
+/// error stops the other workers too, as the run has failed anyway
+fn run_worker(dir: &Path, queue: &SharedQueue, config: &RunConfig) -> Result<()> {
+    let res = take_commits(dir, queue, config);
+    if res.is_err() {
+        queue.stop.store(true, Ordering::SeqCst);
+    }
+    res
+}
+
+fn take_commits(dir: &Path, queue: &SharedQueue, config: &RunConfig) -> Result<()> {
+    let repo = Repository::open(dir).wrap_err("opening worktree")?;
+    loop {
+        if queue.stop.load(Ordering::SeqCst) || config.interrupt.is_set() || config.out_of_time() {
+            return Ok(());
+        }
+        let next = queue.commits.lock().unwrap().next();
+        let (index, oid) = match next {
+            Some(next) => next,
+            None => return Ok(()),
+        };
+
+        let result = process_commit(&repo, dir, oid, config)?;
+        if result.failed() && config.stop_on_failure {
+            tracing::debug!("stopping at first failure");
+            queue.stop.store(true, Ordering::SeqCst);
+        }
+        queue.results.lock().unwrap().push((index, result));
+    }
+}
+
+/// Run the command on `jobs` commits at a time, each worker using its own
+/// temporary worktree so the user's checkout is never touched
+fn run_parallel(
+    workdir: &Path,
+    commits: Vec<git2::Oid>,
+    config: &RunConfig,
+    jobs: usize,
+) -> Result<Vec<CommitResult>> {
+    let n_workers = jobs.min(commits.len());
+
+    // exported trees are already private to each command, so the workers
+    // only need worktrees when checking out
+    let pool = if config.no_checkout {
+        None
+    } else {
+        Some(WorktreePool::new(workdir, n_workers)?)
+    };
+    let dirs = match &pool {
+        Some(pool) => pool
+            .worktrees
+            .iter()
+            .map(|worktree| worktree.path.as_path())
+            .collect(),
+        None => vec![workdir; n_workers],
+    };
+
+    let queue = SharedQueue {
+        commits: Mutex::new(commits.into_iter().enumerate()),
+        results: Mutex::new(Vec::new()),
+        stop: AtomicBool::new(false),
+    };
+
+    std::thread::scope(|s| {
+        let handles = dirs
+            .iter()
+            .map(|dir| s.spawn(|| run_worker(dir, &queue, config)))
+            .collect::<Vec<_>>();
+
+        handles
+            .into_iter()
+            .map(|handle| handle.join().expect("worker thread panicked"))
+            .collect::<Result<Vec<_>>>()
+    })?;
+
+    let mut results = queue.results.into_inner().unwrap();
+    results.sort_by_key(|(index, _)| *index);
+    Ok(results.into_iter().map(|(_, result)| result).collect())
+}
+
+/// Everything a run produced
+#[derive(Debug, Default)]
+pub struct Results {
+    /// Results for each commit the command ran on, in execution order
+    pub commits: Vec<CommitResult>,
+    /// The first failing commit, when bisecting ran to the end
+    pub first_bad: Option<git2::Oid>,
+    /// Skipped commits which could also be the first failure, when bisecting
+    pub undecided: Vec<git2::Oid>,
+    /// The signal which interrupted the run, if any
+    pub signal: Option<i32>,
+    /// Whether --max-runtime ran out before every commit was started
+    pub out_of_time: bool,
+}
+
+impl Results {
+    /// Whether no commit failed
+    pub fn passed(&self) -> bool {
+        !self.commits.iter().any(CommitResult::failed)
+    }
+}
+
+/// What to run and on which commits. Each field corresponds to the command
+/// line flag of the same name
+#[derive(Debug, Clone)]
+pub struct Options {
+    /// The oldest commit to run on, in any form `git rev-parse` accepts
+    pub start: String,
+    /// The newest commit to run on
+    pub end: String,
+    /// Run on exactly these revisions, in this order, instead of walking from
+    /// `start` to `end`. `walk` and `direction` do not apply
+    pub revs: Option<Vec<String>>,
+    /// Fail if one of `revs` does not resolve, rather than leaving it out
+    pub strict_revs: bool,
+    /// The program to run and its arguments, or the words of a shell script
+    /// when `shell` is set
+    pub command: Vec<String>,
+    pub shell: bool,
+    pub walk: WalkOptions,
+    /// Full or abbreviated hashes of commits to leave out, in lowercase
+    pub exclude: Vec<String>,
+    pub direction: Direction,
+    pub limit: Option<usize>,
+    pub jobs: usize,
+    pub timeout: Option<Duration>,
+    pub max_runtime: Option<Duration>,
+    pub retries: u32,
+    pub retry_delay: Duration,
+    pub stop_on_failure: bool,
+    pub bisect: bool,
+    /// Set by `--continue`
+    pub resume: bool,
+    pub dry_run: bool,
+    /// Only write the number of commits that would be visited
+    pub count_only: bool,
+    pub format: Format,
+    pub log_dir: Option<PathBuf>,
+    pub no_checkout: bool,
+    pub submodules: bool,
+    pub stash: bool,
+    /// Overwrite untracked files that a checkout would clobber, instead of
+    /// refusing to run
+    pub force_checkout: bool,
+    pub timing: bool,
+    pub skip_if: Option<String>,
+    pub before: Option<String>,
+    pub after: Option<String>,
+    pub on_failure: Option<String>,
+    pub invert_exit: bool,
+    /// Globs, relative to the working tree, of files to copy into
+    /// `collect_dir` after the command has run on each commit
+    pub collect: Vec<String>,
+    pub collect_dir: Option<PathBuf>,
+    pub collect_passing_only: bool,
+    /// Colour status and summary lines written to the output with ANSI
+    /// escape codes
+    pub color: bool,
+    /// Colour failures and progress written to stderr, which may be a
+    /// terminal when the output is not
+    pub color_stderr: bool,
+    pub progress: ProgressStyle,
+    pub verbosity: Verbosity,
+}
+
+impl Default for Options {
+    fn default() -> Self {
+        Self {
+            start: "HEAD".to_string(),
+            end: "HEAD".to_string(),
+            revs: None,
+            strict_revs: false,
+            command: Vec::new(),
+            shell: false,
+            walk: WalkOptions::default(),
+            exclude: Vec::new(),
+            direction: Direction::OldestFirst,
+            limit: None,
+            jobs: 1,
+            timeout: None,
+            max_runtime: None,
+            retries: 0,
+            retry_delay: Duration::ZERO,
+            stop_on_failure: true,
+            bisect: false,
+            resume: false,
+            dry_run: false,
+            count_only: false,
+            format: Format::Human,
+            log_dir: None,
+            no_checkout: false,
+            submodules: false,
+            stash: false,
+            force_checkout: false,
+            timing: false,
+            skip_if: None,
+            before: None,
+            after: None,
+            on_failure: None,
+            invert_exit: false,
+            collect: Vec::new(),
+            collect_dir: None,
+            collect_passing_only: false,
+            color: false,
+            color_stderr: false,
+            progress: ProgressStyle::Off,
+            verbosity: Verbosity::Normal,
+        }
+    }
+}
+
+/// Called with each commit's result as soon as the command finishes on it.
+/// With more than one job it is called from the worker threads
+pub type OnResult = Box<dyn Fn(&CommitResult) + Send + Sync>;
+
+/// Runs a command on a range of commits in a repository.
+///
+/// Results go to stdout and the tool's other messages to stderr unless other
+/// writers are given. Everything else comes from the [`Options`] rather than
+/// the command line, and the process environment is only used to find the
+/// command on `PATH` and is passed on to the commands run, so a `Runner` can
+/// be embedded in other programs as well as driving the command line tool.
+pub struct Runner {
+    repo: Repository,
+    options: Options,
+    interrupt: Interrupt,
+    out: Output,
+    err: Output,
+    on_result: Option<OnResult>,
+}
+
+impl Runner {
+    pub fn new(repo: Repository, options: Options) -> Self {
+        Self {
+            repo,
+            options,
+            interrupt: Interrupt::default(),
+            out: Output::stdout(),
+            err: Output::stderr(),
+            on_result: None,
+        }
+    }
+
+    /// Open the repository containing `path`, which may be anywhere inside
+    /// its working tree
+    pub fn open(path: impl AsRef<Path>, options: Options) -> Result<Self> {
+        let path = path.as_ref();
+        let repo = Repository::discover(path)
+            .wrap_err_with(|| format!("finding repo containing {}", path.display()))?;
+        Ok(Self::new(repo, options))
+    }
+
+    /// Write results to `writer` instead of stdout
+    pub fn output(mut self, writer: impl Write + Send + 'static) -> Self {
+        self.out = Output::new(writer);
+        self
+    }
+
+    /// Write failures, progress and other messages to `writer` instead of stderr
+    pub fn error_output(mut self, writer: impl Write + Send + 'static) -> Self {
+        self.err = Output::new(writer);
+        self
+    }
+
+    /// Stop the run early once `interrupt` is set, killing any running commands
+    pub fn interrupt(mut self, interrupt: Interrupt) -> Self {
+        self.interrupt = interrupt;
+        self
+    }
+
+    /// Call `on_result` with each commit's result as it completes
+    pub fn on_result(mut self, on_result: impl Fn(&CommitResult) + Send + Sync + 'static) -> Self {
+        self.on_result = Some(Box::new(on_result));
+        self
+    }
+
+    pub fn repo(&self) -> &Repository {
+        &self.repo
+    }
+
+    /// Run the command on every selected commit and write the results
+    pub fn run(self) -> Result<Results> {
+        let Runner {
+            repo,
+            options,
+            interrupt,
+            out,
+            err,
+            on_result,
+        } = self;
+        let repo = &repo;
+        let mut config = RunConfig {
+            command: options.command.clone(),
+            shell: options.shell,
+            stop_on_failure: options.stop_on_failure,
+            timeout: options.timeout,
+            retries: options.retries,
+            retry_delay: options.retry_delay,
+            interrupt,
+            deadline: options.max_runtime.map(|max| Instant::now() + max),
+            ran_out: AtomicBool::new(false),
+            format: options.format,
+            log_dir: options.log_dir.clone(),
+            no_checkout: options.no_checkout,
+            submodules: options.submodules,
+            stash: options.stash,
+            force_checkout: options.force_checkout,
+            timing: options.timing,
+            skip_if: options.skip_if.clone(),
+            before: options.before.clone(),
+            after: options.after.clone(),
+            on_failure: options.on_failure.clone(),
+            invert_exit: options.invert_exit,
+            color: options.color,
+            color_stderr: options.color_stderr,
+            tags: tag_map(repo)?,
+            state: None,
+            verbosity: options.verbosity,
+            progress: None,
+            collect: None,
+            out,
+            err,
+            on_result,
+        };
+
+        // fail before checking anything out rather than on every commit
+        if !options.shell && !options.dry_run && !options.count_only {
+            let program = options
+                .command
+                .first()
+                .ok_or_else(|| eyre::eyre!("no command given"))?;
+            // a placeholder is only known once a commit is chosen
+            if !program.contains('{') && find_program(program).is_none() {
+                eyre::bail!(
+                    "command {} not found on PATH, check the spelling or pass --shell for shell builtins",
+                    program
+                );
+            }
+        }
+
+        let (start, end) = (options.start.as_str(), options.end.as_str());
+        let mut commits = match &options.revs {
+            Some(revs) => resolve_revs(repo, revs, options.strict_revs, &config)?,
+            None => {
+                let commits = get_commits(repo, start, end, &options.walk, &config.tags)
+                    .wrap_err("computing commits")?;
+                order_commits(commits, options.direction)
+            }
+        };
+        if !options.exclude.is_empty() {
+            let before = commits.len();
+            commits.retain(|oid| {
+                let hash = oid.to_string();
+                !options
+                    .exclude
+                    .iter()
+                    .any(|prefix| hash.starts_with(prefix.as_str()))
+            });
+            config.log(
+                Verbosity::Normal,
+                format_args!(
+                    "Skipping {} commits listed in --skip-file",
+                    before - commits.len()
+                ),
+            );
+        }
+        if let Some(limit) = options.limit {
+            commits.truncate(limit);
+        }
+        tracing::debug!(?commits, "got commits");
+
+        if options.count_only {
+            writeln!(config.out.lock(), "{}", commits.len())?;
+            return Ok(Results::default());
+        }
+
+        if commits.is_empty() {
+            match &options.revs {
+                Some(_) => config.log(Verbosity::Normal, "No revisions to run on"),
+                None => config.log(
+                    Verbosity::Normal,
+                    format_args!("No matching revisions between {} and {}", start, end),
+                ),
+            }
+            // machine readable formats still get an empty document
+            if config.format != Format::Human && !options.dry_run {
+                write_results(&mut *config.out.lock(), &[], &[], &config)?;
+            }
+            return Ok(Results::default());
+        }
+
+        if options.dry_run {
+            let mut out = config.out.lock();
+            for &oid in &commits {
+                let info = CommitInfo::load(repo, oid)?;
+                writeln!(out, "{} {}", info.short, info.subject)?;
+            }
+            // the count goes to stderr so that stdout can be piped elsewhere
+            config.log(Verbosity::Normal, format_args!("{} commits", commits.len()));
+            return Ok(Results::default());
+        }
+
+        let workdir = repo
+            .workdir()
+            .ok_or_else(|| eyre::eyre!("repository has no working tree"))?
+            .to_path_buf();
+
+        if options.jobs == 0 {
+            eyre::bail!("--jobs must be at least 1");
+        }
+        if config.submodules && config.no_checkout {
+            eyre::bail!("--submodules cannot be combined with --no-checkout");
+        }
+
+        if let Some(log_dir) = &config.log_dir {
+            std::fs::create_dir_all(log_dir)
+                .wrap_err_with(|| format!("creating log directory {}", log_dir.display()))?;
+        }
+        if let Some(dir) = &options.collect_dir {
+            config.collect = Some(Collect::new(
+                &options.collect,
+                dir.clone(),
+                options.collect_passing_only,
+            )?);
+        }
+
+        if options.bisect {
+            if options.jobs != 1 {
+                eyre::bail!("--bisect cannot be combined with --jobs");
+            }
+            // bisection always searches forwards from the known good start
+            if options.direction == Direction::NewestFirst {
+                eyre::bail!("--bisect cannot be combined with --reverse");
+            }
+            if options.resume {
+                eyre::bail!("--bisect cannot be combined with --continue");
+            }
+            // bisection relies on the commits being a line of history
+            if options.revs.is_some() {
+                eyre::bail!("--bisect cannot be combined with --revs");
+            }
+            let bisection = run_bisect(repo, &workdir, &commits, &config).wrap_err("bisecting")?;
+            let results = Results {
+                commits: bisection.tested,
+                first_bad: bisection.first_bad,
+                undecided: bisection.undecided,
+                signal: config.interrupt.signal(),
+                out_of_time: config.ran_out.load(Ordering::SeqCst),
+            };
+            print_results(repo, &results, true, &config)?;
+            if results.out_of_time {
+                config.log(
+                    Verbosity::Quiet,
+                    "Bisect stopped early, --max-runtime exceeded",
+                );
+            }
+            return Ok(results);
+        }
+
+        // the state is keyed on hashes so that it survives refs moving between runs
+        let range = match &options.revs {
+            Some(_) => {
+                let hashes = commits
+                    .iter()
+                    .map(|oid| oid.to_string())
+                    .collect::<Vec<_>>();
+                format!("revs:{}", hashes.join(","))
+            }
+            None => format!(
+                "{}..{}",
+                resolve_commit(repo, start)?,
+                resolve_commit(repo, end)?
+            ),
+        };
+        let state = StateFile::open(repo, range, options.resume)?;
+        let previous = state.completed()?;
+        config.state = Some(state);
+
+        // a stopped run has nothing left to resume unless it was interrupted
+        let remaining = if config.stop_on_failure && previous.iter().any(CommitResult::failed) {
+            Vec::new()
+        } else {
+            let done = previous
+                .iter()
+                .map(|result| result.oid)
+                .collect::<HashSet<_>>();
+            commits
+                .iter()
+                .copied()
+                .filter(|oid| !done.contains(oid))
+                .collect()
+        };
+        if !previous.is_empty() {
+            config.log(
+                Verbosity::Normal,
+                format_args!(
+                    "Resuming: skipping {} completed commits, {} to go",
+                    previous.len(),
+                    remaining.len()
+                ),
+            );
+        }
+
+        if options.progress != ProgressStyle::Off {
+            config.progress = Some(Progress::new(
+                options.progress,
+                options.color_stderr,
+                remaining.len(),
+                options.jobs,
+            ));
+        }
+        let config = &config;
+
+        let res = if options.jobs == 1 {
+            run_serial(repo, &workdir, remaining, config)
+        } else {
+            run_parallel(&workdir, remaining, config, options.jobs)
+        };
+        let new_results = res.wrap_err("analysing repo")?;
+        if let Some(progress) = &config.progress {
+            progress.clear(&mut *config.err.lock());
+        }
+
+        // report resumed and new results together, in execution order
+        let mut by_oid = previous
+            .into_iter()
+            .chain(new_results)
+            .map(|result| (result.oid, result))
+            .collect::<HashMap<_, _>>();
+        let results = Results {
+            commits: commits
+                .iter()
+                .filter_map(|oid| by_oid.remove(oid))
+                .collect(),
+            first_bad: None,
+            undecided: Vec::new(),
+            signal: config.interrupt.signal(),
+            out_of_time: config.ran_out.load(Ordering::SeqCst),
+        };
+        print_results(repo, &results, false, config)?;
+        if results.out_of_time {
+            config.log(
+                Verbosity::Quiet,
+                format_args!(
+                    "Stopped early, --max-runtime exceeded with {} commits not run",
+                    commits.len() - results.commits.len()
+                ),
+            );
+        }
+        Ok(results)
+    }
+}
+
+/// Write the results in the configured format, followed by the outcome of a
+/// bisection.
+///
+/// A bisection's commits are tested out of order, so neighbouring results
+/// are not transitions, even when the bisection stopped before finding one.
+fn print_results(
+    repo: &Repository,
+    results: &Results,
+    bisect: bool,
+    config: &RunConfig,
+) -> Result<()> {
+    let mut out = config.out.lock();
+    let transitions = if bisect {
+        Vec::new()
+    } else {
+        transitions(&results.commits)
+    };
+    write_results(&mut *out, &results.commits, &transitions, config)?;
+    if let Some(oid) = results.first_bad {
+        let mut lines = Vec::new();
+        if results.undecided.is_empty() {
+            let info = CommitInfo::load(repo, oid)?;
+            lines.push(format!(
+                "First failing commit: {} {}",
+                info.hash, info.subject
+            ));
+        } else {
+            lines.push("First failing commit is one of:".to_string());
+            for &oid in results.undecided.iter().chain([&oid]) {
+                let info = CommitInfo::load(repo, oid)?;
+                lines.push(format!("  {} {}", info.hash, info.subject));
+            }
+        }
+        for line in lines {
+            match config.format {
+                Format::Human => writeln!(out, "{}", line)?,
+                Format::Json | Format::Csv => config.log(Verbosity::Quiet, line),
+            }
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::cell::Cell;
+
+    /// A repository in a temporary directory whose commits are made a minute
+    /// apart, so that their dates are predictable
+    struct TestRepo {
+        dir: TempDir,
+        repo: Repository,
+        time: Cell<i64>,
+    }
+
+    impl TestRepo {
+        fn new() -> Self {
+            let dir = TempDir::new("test").unwrap();
+            let repo = Repository::init(&dir.path).unwrap();
+            let mut config = repo.config().unwrap();
+            config.set_str("user.name", "Test").unwrap();
+            config.set_str("user.email", "test@example.com").unwrap();
+            Self {
+                dir,
+                repo,
+                time: Cell::new(1_600_000_000),
+            }
+        }
+
+        fn path(&self) -> &Path {
+            &self.dir.path
+        }
+
+        /// Write `files` into the working tree and commit them on top of HEAD
+        fn commit(&self, message: &str, files: &[(&str, &str)]) -> git2::Oid {
+            self.commit_as("Test", message, files)
+        }
+
+        fn commit_as(&self, author: &str, message: &str, files: &[(&str, &str)]) -> git2::Oid {
+            self.make_commit(author, message, files, None)
+        }
+
+        /// Merge `other` into HEAD, writing `files` in the merge commit
+        fn merge(&self, message: &str, other: git2::Oid, files: &[(&str, &str)]) -> git2::Oid {
+            self.make_commit("Test", message, files, Some(other))
+        }
+
+        fn make_commit(
+            &self,
+            author: &str,
+            message: &str,
+            files: &[(&str, &str)],
+            merged: Option<git2::Oid>,
+        ) -> git2::Oid {
+            let mut index = self.repo.index().unwrap();
+            for (name, content) in files {
+                let path = self.path().join(name);
+                std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+                std::fs::write(&path, content).unwrap();
+                index.add_path(Path::new(name)).unwrap();
+            }
+            index.write().unwrap();
+            let tree = self.repo.find_tree(index.write_tree().unwrap()).unwrap();
+
+            let time = self.time.get();
+            self.time.set(time + 60);
+            let email = format!("{}@example.com", author.to_lowercase());
+            let signature =
+                git2::Signature::new(author, &email, &git2::Time::new(time, 0)).unwrap();
+            let parent = self
+                .repo
+                .head()
+                .ok()
+                .map(|head| head.peel_to_commit().unwrap());
+            let merged = merged.map(|oid| self.repo.find_commit(oid).unwrap());
+            let parents = parent.iter().chain(&merged).collect::<Vec<_>>();
+            self.repo
+                .commit(
+                    Some("HEAD"),
+                    &signature,
+                    &signature,
+                    message,
+                    &tree,
+                    &parents,
+                )
+                .unwrap()
+        }
+
+        /// Create `branch` at `oid` and check it out
+        fn new_branch(&self, branch: &str, oid: git2::Oid) {
+            let commit = self.repo.find_commit(oid).unwrap();
+            self.repo.branch(branch, &commit, false).unwrap();
+            self.switch(branch);
+        }
+
+        fn switch(&self, branch: &str) {
+            self.repo
+                .set_head(&format!("refs/heads/{}", branch))
+                .unwrap();
+            self.repo
+                .checkout_head(Some(git2::build::CheckoutBuilder::new().force()))
+                .unwrap();
+        }
+
+        /// Make `n` commits which each write their number to `file`, returning
+        /// them oldest first
+        fn commits(&self, n: usize) -> Vec<git2::Oid> {
+            (1..=n)
+                .map(|i| self.commit(&format!("commit {}", i), &[("file", &format!("{}\n", i))]))
+                .collect()
+        }
+
+        /// A file outside the working tree for commands to append to
+        fn log(&self) -> PathBuf {
+            self.repo.path().join("test-log")
+        }
+
+        /// A script which appends the output of `script` to the log
+        fn record(&self, script: &str) -> String {
+            format!("{} >> {}", script, self.log().display())
+        }
+
+        /// The lines appended to the log so far
+        fn recorded(&self) -> Vec<String> {
+            std::fs::read_to_string(self.log())
+                .unwrap_or_default()
+                .lines()
+                .map(str::to_string)
+                .collect()
+        }
+
+        fn runner(&self, options: Options) -> (Runner, SharedBuf) {
+            let (runner, out, _) = self.runner_with_errors(options);
+            (runner, out)
+        }
+
+        /// A runner along with what it writes to stdout and to stderr
+        fn runner_with_errors(&self, options: Options) -> (Runner, SharedBuf, SharedBuf) {
+            let (out, err) = (SharedBuf::default(), SharedBuf::default());
+            let repo = Repository::open(self.path()).unwrap();
+            let runner = Runner::new(repo, options)
+                .output(out.clone())
+                .error_output(err.clone());
+            (runner, out, err)
+        }
+    }
+
+    /// Options running `script` with `sh -c` on each commit from `start` to HEAD
+    fn sh(start: git2::Oid, script: &str) -> Options {
+        Options {
+            start: start.to_string(),
+            command: vec!["sh".to_string(), "-c".to_string(), script.to_string()],
+            ..Options::default()
+        }
+    }
+
+    /// A script which fails on the commits made by `TestRepo::commits` with
+    /// one of the `numbers`
+    fn fails_on(numbers: &[usize]) -> String {
+        let cases = numbers
+            .iter()
+            .map(|n| n.to_string())
+            .collect::<Vec<_>>()
+            .join("|");
+        format!("case $(cat file) in {}) exit 1;; esac", cases)
+    }
+
+    /// A commit with a side branch merged back into it, returning the base,
+    /// main line, side branch and merge commits
+    fn history_with_merge(repo: &TestRepo) -> [git2::Oid; 4] {
+        let base = repo.commit("base", &[("file", "base\n")]);
+        let main = repo.repo.head().unwrap().name().unwrap().to_string();
+        repo.new_branch("side", base);
+        let side = repo.commit("side", &[("side", "side\n")]);
+        repo.switch(main.trim_start_matches("refs/heads/"));
+        let line = repo.commit("main", &[("file", "main\n")]);
+        let merge = repo.merge("merge", side, &[("side", "side\n")]);
+        [base, line, side, merge]
+    }
+
+    /// The commits from `start` to HEAD which `walk` keeps
+    fn walked(repo: &TestRepo, start: git2::Oid, walk: WalkOptions) -> Vec<git2::Oid> {
+        let (runner, _) = repo.runner(Options {
+            walk,
+            ..sh(start, "true")
+        });
+        oids(&runner.run().unwrap())
+    }
+
+    /// The per-commit objects of a `--format json` document
+    fn json_commits(out: &SharedBuf) -> Vec<serde_json::Value> {
+        serde_json::from_str(&out.contents()).unwrap()
+    }
+
+    fn oids(results: &Results) -> Vec<git2::Oid> {
+        results.commits.iter().map(|result| result.oid).collect()
+    }
+
+    /// A writer which can still be read after a `Runner` has taken it
+    #[derive(Clone, Default)]
+    struct SharedBuf(Arc<Mutex<Vec<u8>>>);
+
+    impl SharedBuf {
+        fn contents(&self) -> String {
+            String::from_utf8(self.0.lock().unwrap().clone()).unwrap()
+        }
+    }
+
+    impl Write for SharedBuf {
+        fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+            self.0.lock().unwrap().extend_from_slice(buf);
+            Ok(buf.len())
+        }
+
+        fn flush(&mut self) -> std::io::Result<()> {
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn runs_once_on_each_commit_oldest_first() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let (runner, out) = repo.runner(sh(commits[0], &repo.record("cat file")));
+        let results = runner.run().unwrap();
+
+        assert!(results.passed());
+        assert_eq!(oids(&results), commits);
+        assert_eq!(repo.recorded(), ["1", "2", "3"]);
+        for oid in commits {
+            assert!(out
+                .contents()
+                .contains(&format!("Commit {} successful", oid)));
+        }
+    }
+
+    #[test]
+    fn leaves_out_commits_outside_the_range() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(4);
+
+        let options = Options {
+            end: commits[2].to_string(),
+            ..sh(commits[1], &repo.record("cat file"))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(oids(&results), &commits[1..3]);
+        assert_eq!(repo.recorded(), ["2", "3"]);
+    }
+
+    #[test]
+    fn parallel_jobs_leave_the_checkout_alone() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(4);
+
+        let options = Options {
+            jobs: 2,
+            ..sh(commits[0], &repo.record("cat file"))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        // results are reported in commit order however the jobs finished
+        assert_eq!(oids(&results), commits);
+        let mut recorded = repo.recorded();
+        recorded.sort();
+        assert_eq!(recorded, ["1", "2", "3", "4"]);
+        assert_eq!(repo.repo.head().unwrap().target(), Some(commits[3]));
+        assert_eq!(
+            std::fs::read_to_string(repo.path().join("file")).unwrap(),
+            "4\n"
+        );
+    }
+
+    #[test]
+    fn parallel_error_stops_the_other_jobs() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(6);
+        let log_dir = TempDir::new("test-logs").unwrap();
+        // writing the first commit's log fails once its command has run
+        std::fs::create_dir(log_dir.path.join(format!("{}.out", short_id(commits[0])))).unwrap();
+
+        let script = format!(
+            "[ \"$(cat file)\" = 1 ] || sleep 0.3; {}",
+            repo.record("cat file")
+        );
+        let options = Options {
+            jobs: 2,
+            log_dir: Some(log_dir.path.clone()),
+            ..sh(commits[0], &script)
+        };
+        let (runner, _) = repo.runner(options);
+
+        assert!(runner.run().is_err());
+        assert!(repo.recorded().len() <= 2, "ran {:?}", repo.recorded());
+    }
+
+    #[test]
+    fn restores_the_branch_after_a_failure() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+        let branch = repo.repo.head().unwrap().name().unwrap().to_string();
+
+        let (runner, _) = repo.runner(sh(commits[0], &fails_on(&[2])));
+        let results = runner.run().unwrap();
+
+        assert!(!results.passed());
+        let head = repo.repo.head().unwrap();
+        assert_eq!(head.name(), Some(branch.as_str()));
+        assert_eq!(head.target(), Some(commits[2]));
+        assert_eq!(
+            std::fs::read_to_string(repo.path().join("file")).unwrap(),
+            "3\n"
+        );
+    }
+
+    #[test]
+    fn restores_a_detached_head() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+        repo.repo.set_head_detached(commits[1]).unwrap();
+        repo.repo
+            .checkout_head(Some(git2::build::CheckoutBuilder::new().force()))
+            .unwrap();
+
+        let (runner, _) = repo.runner(Options {
+            end: commits[2].to_string(),
+            ..sh(commits[0], "true")
+        });
+        runner.run().unwrap();
+
+        let head = repo.repo.head().unwrap();
+        assert!(!head.is_branch());
+        assert_eq!(head.target(), Some(commits[1]));
+        assert_eq!(
+            std::fs::read_to_string(repo.path().join("file")).unwrap(),
+            "2\n"
+        );
+    }
+
+    #[test]
+    fn splits_a_range_into_start_and_end() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+        let (start, end) = (commits[0].to_string(), commits[2].to_string());
+
+        let range = format!("{}..{}", start, end);
+        assert_eq!(
+            parse_range(&repo.repo, &range).unwrap(),
+            (start.clone(), end.clone())
+        );
+        assert_eq!(
+            parse_range(&repo.repo, &format!("{}..", start)).unwrap(),
+            (start.clone(), "HEAD".to_string())
+        );
+        assert!(parse_range(&repo.repo, &start).is_err());
+    }
+
+    #[test]
+    fn symmetric_range_starts_at_the_merge_base() {
+        let repo = TestRepo::new();
+        let base = repo.commit("base", &[("file", "base\n")]);
+        let main = repo.repo.head().unwrap().name().unwrap().to_string();
+        repo.commit("main", &[("file", "main\n")]);
+        repo.new_branch("side", base);
+        repo.commit("side", &[("file", "side\n")]);
+
+        assert_eq!(
+            parse_range(&repo.repo, &format!("{}...side", main)).unwrap(),
+            (base.to_string(), "side".to_string())
+        );
+    }
+
+    #[test]
+    fn stops_at_the_first_failure() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(4);
+
+        let script = format!("{}; {}", repo.record("cat file"), fails_on(&[2]));
+        let (runner, out) = repo.runner(sh(commits[0], &script));
+        let results = runner.run().unwrap();
+
+        assert_eq!(oids(&results), &commits[..2]);
+        assert_eq!(repo.recorded(), ["1", "2"]);
+        let summary = format!(
+            "Summary:\n  {} PASS\n  {} FAIL\n",
+            short_id(commits[0]),
+            short_id(commits[1])
+        );
+        assert!(out.contents().contains(&summary), "{}", out.contents());
+    }
+
+    #[test]
+    fn keeps_going_past_failures() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(4);
+
+        let options = Options {
+            stop_on_failure: false,
+            ..sh(commits[0], &fails_on(&[2, 3]))
+        };
+        let (runner, out) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert!(!results.passed());
+        assert_eq!(oids(&results), commits);
+        let statuses = results
+            .commits
+            .iter()
+            .map(CommitResult::status)
+            .collect::<Vec<_>>();
+        assert_eq!(statuses, ["PASS", "FAIL", "FAIL", "PASS"]);
+        assert!(out.contents().contains(&format!(
+            "  {} FAIL\n  {} PASS\n",
+            short_id(commits[2]),
+            short_id(commits[3])
+        )));
+    }
+
+    #[test]
+    fn exposes_commit_metadata_in_the_environment() {
+        let repo = TestRepo::new();
+        let oid = repo.commit_as("Alice", "Add a file\n\nWith a body", &[("file", "1\n")]);
+
+        let script = repo.record(
+            "echo \"$GIT_REV_HASH|$GIT_REV_SHORT|$GIT_REV_AUTHOR|$GIT_REV_AUTHOR_EMAIL|$GIT_REV_DATE|$GIT_REV_SUBJECT\"",
+        );
+        let (runner, _) = repo.runner(sh(oid, &script));
+        runner.run().unwrap();
+
+        let expected = format!(
+            "{}|{}|Alice|alice@example.com|2020-09-13T12:26:40+00:00|Add a file",
+            oid,
+            short_id(oid)
+        );
+        assert_eq!(repo.recorded(), [expected]);
+    }
+
+    #[test]
+    fn dry_run_lists_commits_without_running() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let options = Options {
+            dry_run: true,
+            ..sh(commits[0], &repo.record("cat file"))
+        };
+        let (runner, out) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert!(results.commits.is_empty());
+        assert!(repo.recorded().is_empty());
+        assert_eq!(
+            out.contents(),
+            format!(
+                "{} commit 1\n{} commit 2\n",
+                short_id(commits[0]),
+                short_id(commits[1])
+            )
+        );
+        assert_eq!(
+            std::fs::read_to_string(repo.path().join("file")).unwrap(),
+            "2\n"
+        );
+    }
+
+    #[test]
+    fn substitutes_placeholders_in_arguments() {
+        let repo = TestRepo::new();
+        let oid = repo.commit("Add a file", &[("file", "1\n")]);
+
+        let options = Options {
+            command: vec![
+                "sh".to_string(),
+                "-c".to_string(),
+                repo.record("echo \"$0\""),
+                "{short} {subject} {{hash}} {unknown}".to_string(),
+            ],
+            ..sh(oid, "")
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        assert_eq!(
+            repo.recorded(),
+            [format!("{} Add a file {{hash}} {{unknown}}", short_id(oid))]
+        );
+    }
+
+    #[test]
+    fn shell_scripts_do_not_run_commit_metadata() {
+        let repo = TestRepo::new();
+        let oid = repo.commit("Subject; echo injected", &[("file", "1\n")]);
+
+        let options = Options {
+            shell: true,
+            command: vec![repo.record("echo command {subject}")],
+            before: Some(repo.record("echo before {subject}")),
+            after: Some(repo.record("echo after {subject}")),
+            ..sh(oid, "")
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        assert_eq!(
+            repo.recorded(),
+            [
+                "before Subject; echo injected",
+                "command Subject; echo injected",
+                "after Subject; echo injected",
+            ]
+        );
+    }
+
+    #[test]
+    fn shell_mode_runs_pipelines() {
+        let repo = TestRepo::new();
+        let oids = repo.commits(2);
+
+        let options = Options {
+            shell: true,
+            command: vec![
+                repo.record("cat file | tr 12 ab"),
+                "&&".to_string(),
+                repo.record("echo done"),
+            ],
+            ..sh(oids[0], "")
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        assert_eq!(repo.recorded(), ["a", "done", "b", "done"]);
+    }
+
+    #[test]
+    fn commands_run_directly_without_shell_mode() {
+        let repo = TestRepo::new();
+        let oid = repo.commit("commit", &[("file", "1\n")]);
+
+        // the argument reaches the command intact instead of being split by a shell
+        let script = repo.record("echo \"$1\"");
+        let options = Options {
+            command: ["sh", "-c", &script, "sh", "a && b | c"]
+                .map(String::from)
+                .to_vec(),
+            ..sh(oid, "")
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        assert_eq!(repo.recorded(), ["a && b | c"]);
+    }
+
+    #[test]
+    fn reverse_runs_newest_first() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let options = Options {
+            direction: Direction::NewestFirst,
+            ..sh(commits[0], &repo.record("cat file"))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(oids(&results), [commits[2], commits[1], commits[0]]);
+        assert_eq!(repo.recorded(), ["3", "2", "1"]);
+    }
+
+    #[test]
+    fn first_parent_follows_the_main_line() {
+        let repo = TestRepo::new();
+        let [base, line, side, merge] = history_with_merge(&repo);
+
+        let (runner, _) = repo.runner(sh(base, "true"));
+        let mut all = oids(&runner.run().unwrap());
+        all.sort();
+        let mut expected = vec![base, line, side, merge];
+        expected.sort();
+        assert_eq!(all, expected);
+
+        let options = Options {
+            walk: WalkOptions {
+                first_parent: true,
+                ..WalkOptions::default()
+            },
+            ..sh(base, "true")
+        };
+        let (runner, _) = repo.runner(options);
+        assert_eq!(oids(&runner.run().unwrap()), [base, line, merge]);
+    }
+
+    #[test]
+    fn no_merges_leaves_out_merge_commits() {
+        let repo = TestRepo::new();
+        let [base, line, side, _] = history_with_merge(&repo);
+
+        let walk = WalkOptions {
+            no_merges: true,
+            ..WalkOptions::default()
+        };
+        let mut kept = walked(&repo, base, walk);
+        kept.sort();
+        let mut expected = vec![base, line, side];
+        expected.sort();
+        assert_eq!(kept, expected);
+    }
+
+    #[test]
+    fn timeout_kills_the_command() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+        let script = format!("(sleep 0.5; {}) & sleep 10", repo.record("echo late"));
+
+        let options = Options {
+            timeout: Some(Duration::from_millis(200)),
+            stop_on_failure: false,
+            ..sh(commits[0], &script)
+        };
+        let (runner, _) = repo.runner(options);
+        let started = Instant::now();
+        let results = runner.run().unwrap();
+
+        assert!(started.elapsed() < Duration::from_secs(5));
+        // the command's children are killed along with it
+        std::thread::sleep(Duration::from_millis(800));
+        assert!(repo.recorded().is_empty());
+        let outcomes = results
+            .commits
+            .iter()
+            .map(|result| result.outcome)
+            .collect::<Vec<_>>();
+        assert_eq!(outcomes, [Outcome::TimedOut, Outcome::TimedOut]);
+        assert_eq!(results.commits[0].status(), "TIMEOUT");
+    }
+
+    #[test]
+    fn interrupt_stops_before_the_next_commit() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+        let branch = repo.repo.head().unwrap().name().unwrap().to_string();
+
+        let interrupt = Interrupt::default();
+        let (runner, _) = repo.runner(sh(commits[0], "true"));
+        let signal = interrupt.clone();
+        let results = runner
+            .interrupt(interrupt)
+            .on_result(move |_| signal.set(SIGTERM))
+            .run()
+            .unwrap();
+
+        assert_eq!(oids(&results), &commits[..1]);
+        assert_eq!(results.signal, Some(SIGTERM));
+        assert_eq!(repo.repo.head().unwrap().name(), Some(branch.as_str()));
+    }
+
+    #[test]
+    fn interrupt_kills_the_running_command() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let interrupt = Interrupt::default();
+        let signal = interrupt.clone();
+        std::thread::spawn(move || {
+            std::thread::sleep(Duration::from_millis(200));
+            signal.set(SIGINT);
+        });
+        let (runner, _) = repo.runner(sh(commits[0], "sleep 10"));
+        let started = Instant::now();
+        let results = runner.interrupt(interrupt).run().unwrap();
+
+        assert!(started.elapsed() < Duration::from_secs(5));
+        assert_eq!(results.commits.len(), 1);
+        assert_eq!(results.commits[0].outcome, Outcome::Interrupted);
+        assert_eq!(results.signal, Some(SIGINT));
+    }
+
+    #[test]
+    fn interrupted_bisect_keeps_its_results() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(5);
+
+        let interrupt = Interrupt::default();
+        let signal = interrupt.clone();
+        let seen = AtomicUsize::new(0);
+        let options = Options {
+            bisect: true,
+            ..sh(commits[0], &fails_on(&[4, 5]))
+        };
+        let (runner, out) = repo.runner(options);
+        // stop once the passing start and failing end have both been tested
+        let results = runner
+            .interrupt(interrupt)
+            .on_result(move |_| {
+                if seen.fetch_add(1, Ordering::SeqCst) == 1 {
+                    signal.set(SIGINT);
+                }
+            })
+            .run()
+            .unwrap();
+
+        assert_eq!(oids(&results), [commits[0], commits[4]]);
+        assert_eq!(results.signal, Some(SIGINT));
+        assert_eq!(results.first_bad, None);
+        assert!(
+            !out.contents().contains("Transitions:"),
+            "{}",
+            out.contents()
+        );
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn a_real_signal_stops_the_run_and_restores_head() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+        let branch = repo.repo.head().unwrap().name().unwrap().to_string();
+
+        // the only test which installs the handlers, so no other run sees the signal
+        let interrupt = Interrupt::install().unwrap();
+        let received = interrupt.clone();
+        let (runner, _) = repo.runner(sh(commits[0], &repo.record("cat file")));
+        let results = runner
+            .interrupt(interrupt)
+            .on_result(move |_| {
+                unsafe { libc::kill(libc::getpid(), SIGTERM) };
+                // another thread may take the signal, so wait for its handler
+                while !received.is_set() {
+                    std::thread::sleep(Duration::from_millis(1));
+                }
+            })
+            .run()
+            .unwrap();
+
+        assert_eq!(oids(&results), &commits[..1]);
+        assert_eq!(results.signal, Some(SIGTERM));
+        assert_eq!(repo.recorded(), ["1"]);
+        assert_eq!(repo.repo.head().unwrap().name(), Some(branch.as_str()));
+        assert_eq!(
+            std::fs::read_to_string(repo.path().join("file")).unwrap(),
+            "3\n"
+        );
+    }
+
+    #[test]
+    fn path_filter_keeps_commits_touching_the_paths() {
+        let repo = TestRepo::new();
+        let first = repo.commit("file", &[("file", "1\n")]);
+        let a = repo.commit("src a", &[("src/a.rs", "a\n")]);
+        repo.commit("file again", &[("file", "2\n")]);
+        let b = repo.commit("src b", &[("src/nested/b.rs", "b\n")]);
+        repo.commit("docs", &[("docs/src.md", "docs\n")]);
+
+        let options = Options {
+            walk: WalkOptions {
+                paths: vec![PathBuf::from("src")],
+                ..WalkOptions::default()
+            },
+            ..sh(first, &repo.record("echo ran"))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(oids(&results), [a, b]);
+        assert_eq!(repo.recorded(), ["ran", "ran"]);
+    }
+
+    #[test]
+    fn opens_the_repository_from_a_subdirectory() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+        let nested = repo.path().join("src").join("deep");
+        std::fs::create_dir_all(&nested).unwrap();
+
+        let out = SharedBuf::default();
+        let runner = Runner::open(&nested, sh(commits[0], &repo.record("cat file")))
+            .unwrap()
+            .output(out.clone())
+            .error_output(SharedBuf::default());
+        assert_eq!(
+            runner.repo().workdir().unwrap().canonicalize().unwrap(),
+            repo.path().canonicalize().unwrap()
+        );
+        runner.run().unwrap();
+
+        // the command runs at the top of the working tree
+        assert_eq!(repo.recorded(), ["1", "2"]);
+    }
+
+    #[test]
+    fn json_output_has_each_commits_result() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let options = Options {
+            format: Format::Json,
+            stop_on_failure: false,
+            ..sh(commits[0], "echo out; echo err >&2; [ $(cat file) = 1 ]")
+        };
+        let (runner, out) = repo.runner(options);
+        runner.run().unwrap();
+
+        let json = json_commits(&out);
+        assert_eq!(json.len(), 2);
+        for (value, (oid, status, code)) in json
+            .iter()
+            .zip([(commits[0], "PASS", 0), (commits[1], "FAIL", 1)])
+        {
+            assert_eq!(value["hash"], oid.to_string());
+            assert_eq!(value["status"], status);
+            assert_eq!(value["exit_code"], code);
+            assert_eq!(value["stdout"], "out\n");
+            assert_eq!(value["stderr"], "err\n");
+            assert!(value["duration_ms"].is_u64());
+        }
+        assert_eq!(json[0]["subject"], "commit 1");
+    }
+
+    #[test]
+    fn json_output_is_complete_when_interrupted() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let interrupt = Interrupt::default();
+        let signal = interrupt.clone();
+        let options = Options {
+            format: Format::Json,
+            ..sh(commits[0], "true")
+        };
+        let (runner, out) = repo.runner(options);
+        runner
+            .interrupt(interrupt)
+            .on_result(move |_| signal.set(SIGINT))
+            .run()
+            .unwrap();
+
+        let json = json_commits(&out);
+        assert_eq!(json.len(), 1);
+        assert_eq!(json[0]["hash"], commits[0].to_string());
+    }
+
+    #[test]
+    fn log_dir_gets_each_commits_output() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+        let logs = TempDir::new("test-logs").unwrap();
+        let log_dir = logs.path.join("nested");
+
+        let options = Options {
+            log_dir: Some(log_dir.clone()),
+            ..sh(commits[0], "cat file; [ $(cat file) = 1 ] || echo two >&2")
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        let read = |oid, extension| {
+            std::fs::read_to_string(log_dir.join(format!("{}.{}", short_id(oid), extension)))
+                .unwrap()
+        };
+        assert_eq!(read(commits[0], "out"), "1\n");
+        assert_eq!(read(commits[0], "err"), "");
+        assert_eq!(read(commits[1], "out"), "2\n");
+        assert_eq!(read(commits[1], "err"), "two\n");
+    }
+
+    #[test]
+    fn bisect_finds_the_first_failing_commit() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(8);
+
+        let options = Options {
+            bisect: true,
+            ..sh(commits[0], &fails_on(&[5, 6, 7, 8]))
+        };
+        let (runner, out) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(results.first_bad, Some(commits[4]));
+        assert!(results.undecided.is_empty());
+        // the two ends, then a binary search of the six commits between them
+        assert!(
+            results.commits.len() <= 5,
+            "tested {}",
+            results.commits.len()
+        );
+        assert!(out
+            .contents()
+            .contains(&format!("First failing commit: {} commit 5\n", commits[4])));
+        assert_eq!(repo.repo.head().unwrap().target(), Some(commits[7]));
+    }
+
+    #[test]
+    fn bisect_needs_a_passing_start() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let options = Options {
+            bisect: true,
+            ..sh(commits[0], "false")
+        };
+        let (runner, _) = repo.runner(options);
+        let error = format!("{:#}", runner.run().unwrap_err());
+
+        assert!(
+            error.contains("already fails on the start commit"),
+            "{}",
+            error
+        );
+    }
+
+    #[test]
+    fn limit_caps_the_number_of_commits() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(5);
+
+        let options = Options {
+            limit: Some(2),
+            ..sh(commits[0], &repo.record("cat file"))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(oids(&results), &commits[..2]);
+        assert_eq!(repo.recorded(), ["1", "2"]);
+    }
+
+    #[test]
+    fn no_checkout_runs_on_an_exported_tree() {
+        let repo = TestRepo::new();
+        let first = repo.commit("one", &[("file", "1\n"), ("src/nested", "a\n")]);
+        repo.commit("two", &[("file", "2\n"), ("src/nested", "b\n")]);
+        // uncommitted changes are left alone rather than refused
+        std::fs::write(repo.path().join("file"), "dirty\n").unwrap();
+
+        let options = Options {
+            no_checkout: true,
+            ..sh(first, &repo.record("echo $(cat file src/nested) $(pwd)"))
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        let recorded = repo.recorded();
+        assert_eq!(recorded.len(), 2);
+        assert!(recorded[0].starts_with("1 a "), "{}", recorded[0]);
+        assert!(recorded[1].starts_with("2 b "), "{}", recorded[1]);
+        let workdir = repo.path().canonicalize().unwrap();
+        assert!(!recorded[0].ends_with(&*workdir.to_string_lossy()));
+        assert_eq!(
+            std::fs::read_to_string(repo.path().join("file")).unwrap(),
+            "dirty\n"
+        );
+    }
+
+    #[test]
+    fn refuses_a_dirty_working_tree() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+        std::fs::write(repo.path().join("file"), "dirty\n").unwrap();
+
+        let (runner, _) = repo.runner(sh(commits[0], &repo.record("cat file")));
+        let error = format!("{:#}", runner.run().unwrap_err());
+
+        assert!(
+            error.contains("--stash") && error.contains("file"),
+            "{}",
+            error
+        );
+        assert!(repo.recorded().is_empty());
+    }
+
+    #[test]
+    fn stash_restores_uncommitted_changes() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+        std::fs::write(repo.path().join("file"), "dirty\n").unwrap();
+
+        let options = Options {
+            stash: true,
+            ..sh(commits[0], &repo.record("cat file"))
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        assert_eq!(repo.recorded(), ["1", "2"]);
+        assert_eq!(
+            std::fs::read_to_string(repo.path().join("file")).unwrap(),
+            "dirty\n"
+        );
+    }
+
+    #[test]
+    fn grep_selects_commits_by_message() {
+        let repo = TestRepo::new();
+        let first = repo.commit("Fix ABC-1 crash", &[("file", "1\n")]);
+        let second = repo.commit("tidy up", &[("file", "2\n")]);
+        let third = repo.commit("refactor\n\nPart of abc-1", &[("file", "3\n")]);
+
+        let grep = |pattern: &str, ignore_case, invert| WalkOptions {
+            grep: Some(
+                regex::RegexBuilder::new(pattern)
+                    .case_insensitive(ignore_case)
+                    .build()
+                    .unwrap(),
+            ),
+            grep_invert: invert,
+            ..WalkOptions::default()
+        };
+        // the whole message is matched, not only the subject
+        assert_eq!(walked(&repo, first, grep("abc-1", false, false)), [third]);
+        assert_eq!(
+            walked(&repo, first, grep("abc-1", true, false)),
+            [first, third]
+        );
+        assert_eq!(walked(&repo, first, grep("abc-1", true, true)), [second]);
+    }
+
+    #[test]
+    fn grep_stacks_with_the_other_filters() {
+        let repo = TestRepo::new();
+        let [base, line, _, merge] = history_with_merge(&repo);
+        let later = repo.commit("main again", &[("src/a", "a\n")]);
+
+        let walk = WalkOptions {
+            grep: Some(Regex::new("main|merge").unwrap()),
+            ..WalkOptions::default()
+        };
+        assert_eq!(walked(&repo, base, walk.clone()), [line, merge, later]);
+        let no_merges = WalkOptions {
+            no_merges: true,
+            ..walk.clone()
+        };
+        assert_eq!(walked(&repo, base, no_merges), [line, later]);
+        let paths = WalkOptions {
+            paths: vec![PathBuf::from("src")],
+            ..walk
+        };
+        assert_eq!(walked(&repo, base, paths), [later]);
+    }
+
+    #[test]
+    fn author_filter_matches_name_or_email() {
+        let repo = TestRepo::new();
+        let first = repo.commit_as("Alice Smith", "one", &[("file", "1\n")]);
+        let second = repo.commit_as("Bob", "two", &[("file", "2\n")]);
+        let third = repo.commit_as("Carol", "three", &[("file", "3\n")]);
+
+        let author = |needle: &str| WalkOptions {
+            author: Some(needle.to_string()),
+            ..WalkOptions::default()
+        };
+        assert_eq!(walked(&repo, first, author("smith")), [first]);
+        assert_eq!(walked(&repo, first, author("aLICE")), [first]);
+        assert_eq!(walked(&repo, first, author("bob@example")), [second]);
+        assert_eq!(walked(&repo, first, author("nobody")), []);
+        assert_eq!(
+            walked(&repo, first, author("example.com")),
+            [first, second, third]
+        );
+    }
+
+    #[test]
+    fn date_filters_include_their_bounds() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(4);
+        // commits are a minute apart from 2020-09-13T12:26:40Z
+        let second = 1_600_000_060;
+
+        let dates = |since, until| WalkOptions {
+            since,
+            until,
+            ..WalkOptions::default()
+        };
+        assert_eq!(
+            walked(&repo, commits[0], dates(Some(second), None)),
+            &commits[1..]
+        );
+        assert_eq!(
+            walked(&repo, commits[0], dates(None, Some(second))),
+            &commits[..2]
+        );
+        assert_eq!(
+            walked(&repo, commits[0], dates(Some(second), Some(second + 60))),
+            &commits[1..3]
+        );
+    }
+
+    #[test]
+    fn date_bounds_cover_whole_days() {
+        let since = parse_date_bound("2020-09-13", false).unwrap();
+        let until = parse_date_bound("2020-09-13", true).unwrap();
+        assert_eq!(until - since, 24 * 60 * 60 - 1);
+        assert_eq!(
+            parse_date_bound("2020-09-13T12:26:40+02:00", false).unwrap(),
+            1_600_000_000 - 2 * 60 * 60
+        );
+        assert!(parse_date_bound("13/09/2020", false).is_err());
+    }
+
+    #[test]
+    fn no_matching_revisions_is_not_an_error() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let options = Options {
+            walk: WalkOptions {
+                author: Some("nobody".to_string()),
+                ..WalkOptions::default()
+            },
+            ..sh(commits[0], &repo.record("echo ran"))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert!(results.commits.is_empty());
+        assert!(repo.recorded().is_empty());
+    }
+
+    #[test]
+    fn timing_reports_each_commits_duration() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let options = Options {
+            timing: true,
+            ..sh(commits[0], "sleep 0.1")
+        };
+        let (runner, out) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(results.commits.len(), 2);
+        for result in &results.commits {
+            assert!(result.duration >= Duration::from_millis(100));
+        }
+        let summary = out.contents();
+        assert!(summary.contains("Total "), "{}", summary);
+        assert!(summary.contains(", mean "), "{}", summary);
+    }
+
+    #[test]
+    fn json_output_has_durations_with_timing() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let options = Options {
+            timing: true,
+            format: Format::Json,
+            ..sh(commits[0], "sleep 0.05")
+        };
+        let (runner, out) = repo.runner(options);
+        runner.run().unwrap();
+
+        let json = json_commits(&out);
+        assert_eq!(json.len(), 3);
+        for value in json {
+            assert!(value["duration_ms"].as_u64().unwrap() >= 50, "{}", value);
+        }
+    }
+
+    #[test]
+    fn continue_skips_completed_commits() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+        let script = repo.record("cat file");
+
+        let interrupt = Interrupt::default();
+        let signal = interrupt.clone();
+        let (runner, _) = repo.runner(sh(commits[0], &script));
+        runner
+            .interrupt(interrupt)
+            .on_result(move |_| signal.set(SIGINT))
+            .run()
+            .unwrap();
+        assert_eq!(repo.recorded(), ["1"]);
+
+        let options = Options {
+            resume: true,
+            ..sh(commits[0], &script)
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(repo.recorded(), ["1", "2", "3"]);
+        // the earlier result is reported along with the new ones
+        assert_eq!(oids(&results), commits);
+        assert!(results.passed());
+    }
+
+    #[test]
+    fn continue_on_another_range_starts_afresh() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+        let script = repo.record("cat file");
+
+        let (runner, _) = repo.runner(sh(commits[1], &script));
+        runner.run().unwrap();
+
+        let options = Options {
+            resume: true,
+            ..sh(commits[0], &script)
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        assert_eq!(repo.recorded(), ["2", "3", "1", "2", "3"]);
+    }
+
+    #[test]
+    fn runs_everything_again_without_continue() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+        let script = repo.record("cat file");
+
+        for _ in 0..2 {
+            let (runner, _) = repo.runner(sh(commits[0], &script));
+            runner.run().unwrap();
+        }
+
+        assert_eq!(repo.recorded(), ["1", "2", "1", "2"]);
+    }
+
+    #[test]
+    fn runner_returns_the_results() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let (runner, _) = repo.runner(Options {
+            stop_on_failure: false,
+            ..sh(commits[0], &fails_on(&[1]))
+        });
+        let results = runner.run().unwrap();
+
+        assert_eq!(oids(&results), commits);
+        assert_eq!(results.commits[0].outcome, Outcome::Exited(1));
+        assert_eq!(results.commits[1].outcome, Outcome::Exited(0));
+        assert_eq!(results.commits[1].subject, "commit 2");
+        assert!(!results.passed());
+        assert_eq!(results.signal, None);
+    }
+
+    #[test]
+    fn runner_checks_the_command_before_checking_out() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+        let head = repo.repo.head().unwrap().target();
+
+        let (runner, _) = repo.runner(Options {
+            command: vec!["no-such-program-anywhere".to_string()],
+            ..sh(commits[0], "")
+        });
+        let error = runner.run().unwrap_err().to_string();
+        assert!(error.contains("not found on PATH"), "{}", error);
+
+        let (runner, _) = repo.runner(Options {
+            command: Vec::new(),
+            ..sh(commits[0], "")
+        });
+        assert_eq!(runner.run().unwrap_err().to_string(), "no command given");
+        assert_eq!(repo.repo.head().unwrap().target(), head);
+    }
+
+    #[test]
+    fn runner_open_needs_a_repository() {
+        let dir = TempDir::new("test-not-a-repo").unwrap();
+        assert!(Runner::open(&dir.path, Options::default()).is_err());
+    }
+
+    #[test]
+    fn resolves_tags_short_hashes_and_relative_refs() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(5);
+        let object = repo.repo.find_object(commits[1], None).unwrap();
+        repo.repo.tag_lightweight("v1.0", &object, false).unwrap();
+        let signature = repo.repo.signature().unwrap();
+        repo.repo
+            .tag("v1.1", &object, &signature, "annotated", false)
+            .unwrap();
+
+        let resolve = |rev: &str| resolve_commit(&repo.repo, rev).unwrap();
+        assert_eq!(resolve("v1.0"), commits[1]);
+        assert_eq!(resolve("v1.1"), commits[1]);
+        assert_eq!(resolve(&short_id(commits[2])), commits[2]);
+        assert_eq!(resolve("HEAD"), commits[4]);
+        assert_eq!(resolve("HEAD~3"), commits[1]);
+        assert_eq!(resolve("HEAD^"), commits[3]);
+
+        // the range ends resolve the same way
+        let (runner, _) = repo.runner(Options {
+            start: "v1.1".to_string(),
+            end: "HEAD~1".to_string(),
+            ..sh(commits[0], "true")
+        });
+        assert_eq!(oids(&runner.run().unwrap()), &commits[1..4]);
+    }
+
+    #[test]
+    fn unknown_revisions_are_named_in_the_error() {
+        let repo = TestRepo::new();
+        repo.commits(1);
+
+        let error = format!(
+            "{:#}",
+            resolve_commit(&repo.repo, "no-such-ref").unwrap_err()
+        );
+        assert!(error.contains("no-such-ref"), "{}", error);
+        assert!(error.contains("HEAD~3"), "{}", error);
+    }
+
+    #[test]
+    fn before_and_after_run_around_the_command() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let options = Options {
+            before: Some(repo.record("echo before $GIT_REV_SUBJECT")),
+            after: Some(repo.record("echo after $GIT_REV_SUBJECT")),
+            ..sh(commits[0], &repo.record("echo command $GIT_REV_SUBJECT"))
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        assert_eq!(
+            repo.recorded(),
+            [
+                "before commit 1",
+                "command commit 1",
+                "after commit 1",
+                "before commit 2",
+                "command commit 2",
+                "after commit 2",
+            ]
+        );
+    }
+
+    #[test]
+    fn failing_before_skips_the_command() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let before = format!("{}; [ $(cat file) = 2 ]", repo.record("echo before"));
+        let options = Options {
+            before: Some(before),
+            after: Some(repo.record("echo after")),
+            stop_on_failure: false,
+            ..sh(commits[0], &repo.record("echo command"))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(results.commits[0].outcome, Outcome::SetupFailed(1));
+        assert_eq!(results.commits[0].status(), "SETUP_FAILED");
+        assert_eq!(results.commits[1].outcome, Outcome::Exited(0));
+        assert_eq!(
+            repo.recorded(),
+            ["before", "after", "before", "command", "after"]
+        );
+    }
+
+    #[test]
+    fn after_runs_past_failures_unless_stopping() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+        let command = format!("{}; {}", repo.record("echo command"), fails_on(&[1]));
+
+        let options = Options {
+            after: Some(repo.record("echo after")),
+            stop_on_failure: false,
+            ..sh(commits[0], &command)
+        };
+        let (runner, _) = repo.runner(options.clone());
+        runner.run().unwrap();
+        assert_eq!(repo.recorded(), ["command", "after", "command", "after"]);
+
+        std::fs::remove_file(repo.log()).unwrap();
+        let (runner, _) = repo.runner(Options {
+            stop_on_failure: true,
+            ..options
+        });
+        runner.run().unwrap();
+        assert_eq!(repo.recorded(), ["command"]);
+    }
+
+    #[test]
+    fn no_escape_codes_without_color() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let options = Options {
+            stop_on_failure: false,
+            timing: true,
+            ..sh(commits[0], &format!("echo output; {}", fails_on(&[2])))
+        };
+        let (runner, out) = repo.runner(options);
+        runner.run().unwrap();
+
+        let output = out.contents();
+        assert!(output.contains("Summary:"), "{}", output);
+        assert!(!output.contains('\x1b'), "{:?}", output);
+    }
+
+    #[test]
+    fn color_highlights_statuses_and_hashes() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let options = Options {
+            color: true,
+            stop_on_failure: false,
+            ..sh(commits[0], &fails_on(&[2]))
+        };
+        let (runner, out) = repo.runner(options);
+        runner.run().unwrap();
+
+        let output = out.contents();
+        assert!(output.contains(&paint(true, YELLOW, short_id(commits[0]))));
+        assert!(output.contains(&paint(true, GREEN, "PASS")), "{:?}", output);
+        assert!(output.contains(&paint(true, RED, "FAIL")), "{:?}", output);
+    }
+
+    #[test]
+    fn retries_pass_a_flaky_command() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(1);
+        // fail on the first attempt only
+        let marker = repo.repo.path().join("test-attempted");
+        let script = format!("[ -e {0} ] || {{ touch {0}; exit 1; }}", marker.display());
+
+        let options = Options {
+            retries: 2,
+            format: Format::Json,
+            ..sh(commits[0], &script)
+        };
+        let (runner, out) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert!(results.passed());
+        assert_eq!(results.commits[0].status(), "PASS");
+        assert_eq!(results.commits[0].attempts, 2);
+        assert_eq!(json_commits(&out)[0]["attempts"], 2);
+    }
+
+    #[test]
+    fn retries_give_up_after_the_last_attempt() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(1);
+
+        let options = Options {
+            retries: 2,
+            retry_delay: Duration::from_millis(10),
+            ..sh(
+                commits[0],
+                &format!("{}; exit 1", repo.record("echo attempt")),
+            )
+        };
+        let (runner, out) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert!(!results.passed());
+        assert_eq!(results.commits[0].attempts, 3);
+        assert_eq!(repo.recorded(), ["attempt", "attempt", "attempt"]);
+        assert!(
+            out.contents().contains("(3 attempts)"),
+            "{}",
+            out.contents()
+        );
+    }
+
+    /// Split an RFC 4180 document into its rows of unquoted fields
+    fn parse_csv(text: &str) -> Vec<Vec<String>> {
+        let mut rows = Vec::new();
+        let mut row = Vec::new();
+        let mut field = String::new();
+        let mut quoted = false;
+        let mut chars = text.chars().peekable();
+        while let Some(c) = chars.next() {
+            match c {
+                '"' if quoted && chars.peek() == Some(&'"') => {
+                    field.push('"');
+                    chars.next();
+                }
+                '"' => quoted = !quoted,
+                ',' if !quoted => row.push(std::mem::take(&mut field)),
+                '\r' if !quoted && chars.peek() == Some(&'\n') => {
+                    chars.next();
+                    row.push(std::mem::take(&mut field));
+                    rows.push(std::mem::take(&mut row));
+                }
+                c => field.push(c),
+            }
+        }
+        assert!(!quoted && field.is_empty() && row.is_empty(), "{:?}", text);
+        rows
+    }
+
+    #[test]
+    fn csv_output_round_trips() {
+        let repo = TestRepo::new();
+        let first = repo.commit("plain", &[("file", "1\n")]);
+        let second = repo.commit("Fix \"quotes\", commas\n\nand a body", &[("file", "2\n")]);
+
+        let options = Options {
+            format: Format::Csv,
+            stop_on_failure: false,
+            ..sh(first, "[ $(cat file) = 1 ]")
+        };
+        let (runner, out) = repo.runner(options);
+        runner.run().unwrap();
+
+        let rows = parse_csv(&out.contents());
+        assert_eq!(rows.len(), 3);
+        assert_eq!(
+            rows[0],
+            [
+                "hash",
+                "short",
+                "author_date",
+                "subject",
+                "exit_code",
+                "duration_ms",
+                "status"
+            ]
+        );
+        assert_eq!(rows[1][0], first.to_string());
+        assert_eq!(rows[1][6], "PASS");
+        let row = &rows[2];
+        assert_eq!(row[0], second.to_string());
+        assert_eq!(row[1], short_id(second));
+        assert_eq!(row[2], "2020-09-13T12:27:40+00:00");
+        assert_eq!(row[3], "Fix \"quotes\", commas");
+        assert_eq!(row[4], "1");
+        assert!(row[5].parse::<u64>().is_ok());
+        assert_eq!(row[6], "FAIL");
+
+        // a field spread over several lines is still one field
+        let field = "two\r\nlines, \"quoted\"";
+        assert_eq!(parse_csv(&format!("{}\r\n", csv_field(field))), [[field]]);
+    }
+
+    #[test]
+    fn submodules_follow_each_commit() {
+        let sub = TestRepo::new();
+        let sub_commits = sub.commits(2);
+        let repo = TestRepo::new();
+        let base = repo.commit("base", &[("file", "base\n")]);
+
+        let url = sub.path().to_string_lossy().into_owned();
+
+        // git refuses to clone local submodules unless allowed
+        let add = ["-c", "protocol.file.allow=always", "submodule", "add", "-q"];
+        git(repo.path(), &[&add[..], &[url.as_str(), "sub"]].concat()).unwrap();
+        let sub_dir = repo.path().join("sub");
+        git(&sub_dir, &["checkout", "-q", &sub_commits[0].to_string()]).unwrap();
+        git(repo.path(), &["add", "sub"]).unwrap();
+        repo.commit("add sub at 1", &[]);
+        git(&sub_dir, &["checkout", "-q", &sub_commits[1].to_string()]).unwrap();
+        git(repo.path(), &["add", "sub"]).unwrap();
+        repo.commit("move sub to 2", &[]);
+
+        let options = Options {
+            submodules: true,
+            ..sh(
+                base,
+                &repo.record("{ cat sub/file || echo none; } 2>/dev/null"),
+            )
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        // the submodule is added, then moved along with the superproject
+        assert_eq!(repo.recorded(), ["none", "1", "2"]);
+    }
+
+    #[test]
+    fn max_runtime_stops_starting_commits() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(4);
+
+        let options = Options {
+            max_runtime: Some(Duration::from_millis(100)),
+            ..sh(commits[0], "sleep 0.3")
+        };
+        let (runner, out) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        // the running command is left to finish
+        assert_eq!(oids(&results), &commits[..1]);
+        assert_eq!(results.commits[0].outcome, Outcome::Exited(0));
+        assert!(results.out_of_time);
+        assert!(out.contents().contains("Summary:"));
+    }
+
+    #[test]
+    fn max_runtime_is_not_hit_by_a_quick_run() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let options = Options {
+            max_runtime: Some(Duration::from_secs(60)),
+            ..sh(commits[0], "true")
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(oids(&results), commits);
+        assert!(!results.out_of_time);
+    }
+
+    #[test]
+    fn skipped_commits_neither_pass_nor_fail() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let command = format!("{}; {}", repo.record("cat file"), fails_on(&[2]));
+        let options = Options {
+            skip_if: Some("[ $(cat file) != 2 ]".to_string()),
+            ..sh(commits[0], &command)
+        };
+        let (runner, out) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(repo.recorded(), ["1", "3"]);
+        assert_eq!(results.commits[1].outcome, Outcome::Skipped);
+        assert!(!results.commits[1].passed() && !results.commits[1].failed());
+        assert!(results.passed());
+        assert!(out.contents().contains("SKIPPED"));
+    }
+
+    #[test]
+    fn bisect_treats_skipped_commits_like_git_bisect_skip() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(8);
+
+        let options = Options {
+            bisect: true,
+            skip_if: Some("[ $(cat file) != 5 ]".to_string()),
+            ..sh(commits[0], &fails_on(&[5, 6, 7, 8]))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        // the skipped commit could be the first failure as well
+        assert_eq!(results.first_bad, Some(commits[5]));
+        assert_eq!(results.undecided, [commits[4]]);
+    }
+
+    #[test]
+    fn embedding_gets_each_result_and_the_output() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let seen = Arc::new(Mutex::new(Vec::new()));
+        let record = seen.clone();
+        let out = SharedBuf::default();
+        let options = Options {
+            stop_on_failure: false,
+            ..sh(commits[0], &fails_on(&[2]))
+        };
+        let results = Runner::new(Repository::open(repo.path()).unwrap(), options)
+            .output(out.clone())
+            .error_output(SharedBuf::default())
+            .on_result(move |result| {
+                let mut record = record.lock().unwrap();
+                record.push((result.oid, result.status()));
+            })
+            .run()
+            .unwrap();
+
+        assert_eq!(
+            *seen.lock().unwrap(),
+            [
+                (commits[0], "PASS"),
+                (commits[1], "FAIL"),
+                (commits[2], "PASS"),
+            ]
+        );
+        assert_eq!(oids(&results), commits);
+        // the summary goes to the given writer rather than stdout
+        let output = out.contents();
+        assert!(output.contains("Summary:"), "{}", output);
+        for oid in &commits {
+            assert!(output.contains(&short_id(*oid)), "{}", output);
+        }
+    }
+
+    #[test]
+    fn on_result_is_called_from_each_job() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(4);
+
+        let seen = Arc::new(Mutex::new(Vec::new()));
+        let record = seen.clone();
+        let options = Options {
+            jobs: 2,
+            ..sh(commits[0], "true")
+        };
+        let (runner, _) = repo.runner(options);
+        runner
+            .on_result(move |result| record.lock().unwrap().push(result.oid))
+            .run()
+            .unwrap();
+
+        let mut seen = seen.lock().unwrap().clone();
+        seen.sort();
+        let mut expected = commits.clone();
+        expected.sort();
+        assert_eq!(seen, expected);
+    }
+
+    #[test]
+    fn on_failure_gets_the_commit_and_exit_code() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let options = Options {
+            on_failure: Some(repo.record("echo $GIT_REV_HASH $GIT_REV_EXIT")),
+            stop_on_failure: false,
+            ..sh(commits[0], "[ $(cat file) = 2 ] && exit 3; true")
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        assert_eq!(repo.recorded(), [format!("{} 3", commits[1])]);
+    }
+
+    #[test]
+    fn on_failure_runs_before_the_run_stops() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let options = Options {
+            on_failure: Some(repo.record("echo failed $GIT_REV_SUBJECT")),
+            ..sh(commits[0], &fails_on(&[2]))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(results.commits.len(), 2);
+        assert_eq!(repo.recorded(), ["failed commit 2"]);
+    }
+
+    #[test]
+    fn skip_file_leaves_out_full_and_abbreviated_hashes() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(4);
+        let dir = TempDir::new("test-skip").unwrap();
+        let path = dir.path.join("skip");
+        let contents = format!(
+            "# known bad\n{}\n\n  {}  # wip, abbreviated\n",
+            commits[1],
+            short_id(commits[2]).to_uppercase()
+        );
+        std::fs::write(&path, contents).unwrap();
+
+        let exclude = read_skip_file(&path).unwrap();
+        assert_eq!(exclude.len(), 2);
+        let options = Options {
+            exclude,
+            ..sh(commits[0], &repo.record("cat file"))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(oids(&results), [commits[0], commits[3]]);
+        assert_eq!(repo.recorded(), ["1", "4"]);
+    }
+
+    #[test]
+    fn skip_file_rejects_other_lines() {
+        let dir = TempDir::new("test-skip").unwrap();
+        let path = dir.path.join("skip");
+        std::fs::write(&path, "abc123\nHEAD~1\n").unwrap();
+
+        let error = read_skip_file(&path).unwrap_err().to_string();
+        assert!(
+            error.ends_with(":2: HEAD~1 is not a commit hash"),
+            "{}",
+            error
+        );
+    }
+
+    #[test]
+    fn plain_progress_prints_one_line_per_commit() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let progress = Progress::new(ProgressStyle::Lines, false, commits.len(), 1);
+        let mut err = Vec::new();
+        for &oid in &commits {
+            let info = CommitInfo::load(&repo.repo, oid).unwrap();
+            progress.start(&info, &mut err);
+            progress.finish(Duration::from_secs(90));
+            // only an in-place line needs clearing
+            progress.clear(&mut err);
+        }
+
+        let err = String::from_utf8(err).unwrap();
+        let lines = err.lines().collect::<Vec<_>>();
+        assert_eq!(lines.len(), 3, "{:?}", err);
+        assert_eq!(lines[0], format!("[1/3] {}", short_id(commits[0])));
+        assert_eq!(lines[1], format!("[2/3] {} ETA 3m", short_id(commits[1])));
+        assert_eq!(
+            lines[2],
+            format!("[3/3] {} ETA 1m 30s", short_id(commits[2]))
+        );
+    }
+
+    #[test]
+    fn in_place_progress_highlights_the_hash() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(1);
+
+        let progress = Progress::new(ProgressStyle::InPlace, true, 1, 1);
+        let mut err = Vec::new();
+        let info = CommitInfo::load(&repo.repo, commits[0]).unwrap();
+        progress.start(&info, &mut err);
+        progress.clear(&mut err);
+
+        let line = format!("[1/1] {}", paint(true, YELLOW, short_id(commits[0])));
+        assert_eq!(
+            String::from_utf8(err).unwrap(),
+            format!("\r\x1b[K{}\r\x1b[K", line)
+        );
+    }
+
+    #[test]
+    fn find_program_searches_path() {
+        assert!(find_program("sh").unwrap().is_absolute());
+        assert_eq!(find_program("no-such-program-anywhere"), None);
+        // a path is resolved in each commit's checkout instead
+        assert_eq!(
+            find_program("./scripts/test.sh"),
+            Some(PathBuf::from("./scripts/test.sh"))
+        );
+    }
+
+    #[test]
+    fn missing_command_fails_before_any_checkout() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+        let started = Arc::new(AtomicUsize::new(0));
+        let count = started.clone();
+
+        let (runner, _) = repo.runner(Options {
+            command: vec!["no-such-program-anywhere".to_string()],
+            ..sh(commits[0], "")
+        });
+        let error = runner
+            .on_result(move |_| {
+                count.fetch_add(1, Ordering::SeqCst);
+            })
+            .run()
+            .unwrap_err();
+
+        assert!(error.to_string().contains("--shell"), "{}", error);
+        assert_eq!(started.load(Ordering::SeqCst), 0);
+        assert_eq!(
+            std::fs::read_to_string(repo.path().join("file")).unwrap(),
+            "2\n"
+        );
+    }
+
+    #[test]
+    fn shell_commands_are_not_looked_up() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(1);
+
+        let (runner, _) = repo.runner(Options {
+            shell: true,
+            command: vec!["no-such-program-anywhere".to_string()],
+            stop_on_failure: false,
+            ..sh(commits[0], "")
+        });
+        let results = runner.run().unwrap();
+
+        assert_eq!(results.commits[0].outcome, Outcome::Exited(127));
+    }
+
+    #[test]
+    fn invert_exit_swaps_pass_and_fail() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let options = Options {
+            invert_exit: true,
+            ..sh(commits[0], &fails_on(&[1, 2]))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        // stopping on the first zero exit code, which now counts as the failure
+        let statuses = results
+            .commits
+            .iter()
+            .map(|result| (result.status(), result.exit_code()))
+            .collect::<Vec<_>>();
+        assert_eq!(
+            statuses,
+            [("PASS", Some(1)), ("PASS", Some(1)), ("FAIL", Some(0))]
+        );
+        assert!(!results.passed());
+    }
+
+    #[test]
+    fn invert_exit_bisects_for_the_fix() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(8);
+
+        // the reproduction fails until commit 6 fixes it
+        let options = Options {
+            bisect: true,
+            invert_exit: true,
+            ..sh(commits[0], &fails_on(&[1, 2, 3, 4, 5]))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(results.first_bad, Some(commits[5]));
+    }
+
+    #[test]
+    fn revs_run_on_exactly_the_given_commits_in_order() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(5);
+
+        let options = Options {
+            revs: Some(
+                [commits[3], commits[0], commits[2]]
+                    .iter()
+                    .map(|&oid| short_id(oid))
+                    .collect(),
+            ),
+            ..sh(commits[0], &repo.record("cat file"))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(oids(&results), [commits[3], commits[0], commits[2]]);
+        assert_eq!(repo.recorded(), ["4", "1", "3"]);
+    }
+
+    #[test]
+    fn unresolved_revs_are_left_out_unless_strict() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+        let revs = vec!["HEAD".to_string(), "no-such-ref".to_string()];
+
+        let options = Options {
+            revs: Some(revs),
+            ..sh(commits[0], &repo.record("cat file"))
+        };
+        let (runner, _) = repo.runner(options.clone());
+        assert_eq!(oids(&runner.run().unwrap()), [commits[1]]);
+
+        let (runner, _) = repo.runner(Options {
+            strict_revs: true,
+            ..options
+        });
+        let error = format!("{:#}", runner.run().unwrap_err());
+        assert!(error.contains("no-such-ref"), "{}", error);
+        assert_eq!(repo.recorded(), ["2"]);
+    }
+
+    #[test]
+    fn fetch_makes_remote_revisions_resolvable() {
+        let remote = TestRepo::new();
+        let repo = TestRepo::new();
+        let local = repo.commits(1);
+        let url = remote.path().to_string_lossy().into_owned();
+        git(repo.path(), &["remote", "add", "origin", &url]).unwrap();
+        let pushed = remote.commit("pushed", &[("file", "remote\n")]);
+        let object = remote.repo.find_object(pushed, None).unwrap();
+        remote.repo.tag_lightweight("v2.0", &object, false).unwrap();
+        let branch = remote.repo.head().unwrap().shorthand().unwrap().to_string();
+        let remote_branch = format!("origin/{}", branch);
+
+        assert!(resolve_commit(&repo.repo, "v2.0").is_err());
+        fetch(&repo.repo, "origin").unwrap();
+
+        assert_eq!(resolve_commit(&repo.repo, "v2.0").unwrap(), pushed);
+        assert_eq!(resolve_commit(&repo.repo, &remote_branch).unwrap(), pushed);
+        assert_eq!(resolve_commit(&repo.repo, "HEAD").unwrap(), local[0]);
+    }
+
+    #[test]
+    fn fetch_needs_a_configured_remote() {
+        let repo = TestRepo::new();
+        repo.commits(1);
+
+        let error = fetch(&repo.repo, "upstream").unwrap_err().to_string();
+        assert_eq!(error, "no remote named upstream is configured");
+    }
+
+    #[test]
+    fn divergent_start_and_end_are_explained() {
+        let repo = TestRepo::new();
+        let base = repo.commit("base", &[("file", "base\n")]);
+        let main = repo.repo.head().unwrap().shorthand().unwrap().to_string();
+        repo.commit("main", &[("file", "main\n")]);
+        repo.new_branch("side", base);
+        repo.commit("side", &[("file", "side\n")]);
+
+        for bisect in [false, true] {
+            let (runner, _) = repo.runner(Options {
+                start: "side".to_string(),
+                end: main.clone(),
+                bisect,
+                ..sh(base, &repo.record("echo ran"))
+            });
+            let error = format!("{:#}", runner.run().unwrap_err());
+            assert!(error.contains(&short_id(base)), "{}", error);
+            assert!(error.contains(&format!("side...{}", main)), "{}", error);
+        }
+        assert!(repo.recorded().is_empty());
+    }
+
+    #[test]
+    fn swapped_start_and_end_suggest_reverse() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let (runner, _) = repo.runner(Options {
+            end: commits[0].to_string(),
+            ..sh(commits[1], "true")
+        });
+        let error = format!("{:#}", runner.run().unwrap_err());
+        assert!(error.contains("--reverse"), "{}", error);
+    }
+
+    #[test]
+    fn collect_copies_artifacts_per_commit() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+        let artifacts = TempDir::new("test-collect").unwrap();
+        let collect_dir = artifacts.path.join("out");
+
+        let options = Options {
+            collect: vec!["build/**/*.txt".to_string()],
+            collect_dir: Some(collect_dir.clone()),
+            ..sh(
+                commits[0],
+                "mkdir -p build/nested && cp file build/nested/result.txt && touch build/skip.log",
+            )
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        for (oid, contents) in commits.iter().zip(["1\n", "2\n"]) {
+            let dir = collect_dir.join(short_id(*oid));
+            let path = dir.join("build").join("nested").join("result.txt");
+            assert_eq!(std::fs::read_to_string(path).unwrap(), contents);
+            assert!(!dir.join("build").join("skip.log").exists());
+        }
+    }
+
+    #[test]
+    fn collect_skips_empty_matches_and_failures_when_asked() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+        let artifacts = TempDir::new("test-collect").unwrap();
+
+        // nothing is produced on commit 1, and commit 2 fails
+        let script = format!(
+            "[ $(cat file) = 1 ] || cp file result.txt; {}",
+            fails_on(&[2])
+        );
+        let options = Options {
+            collect: vec!["result.txt".to_string()],
+            collect_dir: Some(artifacts.path.clone()),
+            collect_passing_only: true,
+            stop_on_failure: false,
+            ..sh(commits[0], &script)
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        let exists = |oid| artifacts.path.join(short_id(oid)).exists();
+        assert!(!exists(commits[0]));
+        assert!(!exists(commits[1]));
+        assert!(exists(commits[2]));
+    }
+
+    #[test]
+    fn quiet_prints_only_the_counts() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let run = |verbosity| {
+            let (runner, out) = repo.runner(Options {
+                verbosity,
+                ..sh(commits[0], "true")
+            });
+            runner.run().unwrap();
+            out.contents()
+        };
+        let quiet = run(Verbosity::Quiet);
+        let normal = run(Verbosity::Normal);
+
+        assert_eq!(quiet, "3 passed, 0 failed, 0 skipped\n");
+        // a line for each commit and the summary
+        assert!(normal.lines().count() >= 7, "{}", normal);
+        assert!(normal.contains(&format!("Commit {} successful", commits[0])));
+    }
+
+    #[test]
+    fn quiet_counts_failures_and_skips() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(3);
+
+        let (runner, out) = repo.runner(Options {
+            verbosity: Verbosity::Quiet,
+            stop_on_failure: false,
+            skip_if: Some("[ $(cat file) != 3 ]".to_string()),
+            ..sh(commits[0], &fails_on(&[1]))
+        });
+        runner.run().unwrap();
+
+        assert_eq!(out.contents(), "1 passed, 1 failed, 1 skipped\n");
+    }
+
+    /// Commits where `generated` is tracked only in the middle one, leaving it
+    /// free to be created as an untracked file
+    fn history_tracking_generated(repo: &TestRepo) -> [git2::Oid; 3] {
+        let first = repo.commit("first", &[("file", "1\n")]);
+        let tracked = repo.commit("track", &[("generated", "tracked\n")]);
+        git(repo.path(), &["rm", "-q", "generated"]).unwrap();
+        let last = repo.commit("untrack", &[("file", "3\n")]);
+        std::fs::write(repo.path().join("generated"), "mine\n").unwrap();
+        [first, tracked, last]
+    }
+
+    #[test]
+    fn untracked_files_in_the_way_are_named_up_front() {
+        let repo = TestRepo::new();
+        let [first, tracked, _] = history_tracking_generated(&repo);
+
+        let (runner, _) = repo.runner(sh(first, &repo.record("echo ran")));
+        let error = format!("{:#}", runner.run().unwrap_err());
+
+        // found before the first commit, which has no conflict, was run
+        assert!(error.contains("--force-checkout"), "{}", error);
+        assert!(
+            error.contains(&format!("generated (tracked in {})", short_id(tracked))),
+            "{}",
+            error
+        );
+        assert!(repo.recorded().is_empty());
+        assert_eq!(
+            std::fs::read_to_string(repo.path().join("generated")).unwrap(),
+            "mine\n"
+        );
+    }
+
+    #[test]
+    fn force_checkout_overwrites_untracked_files() {
+        let repo = TestRepo::new();
+        let [first, ..] = history_tracking_generated(&repo);
+
+        let options = Options {
+            force_checkout: true,
+            ..sh(first, &repo.record("cat generated 2>/dev/null"))
+        };
+        let (runner, _) = repo.runner(options);
+        runner.run().unwrap();
+
+        // the untracked file is left alone where the commit has none
+        assert_eq!(repo.recorded(), ["mine", "tracked"]);
+    }
+
+    #[test]
+    fn transitions_mark_where_the_result_flips() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(5);
+
+        let options = Options {
+            stop_on_failure: false,
+            ..sh(commits[0], &fails_on(&[2, 3]))
+        };
+        let (runner, out) = repo.runner(options);
+        runner.run().unwrap();
+
+        let output = out.contents();
+        let section = output.split("Transitions:").nth(1).expect(&output);
+        let lines = section
+            .lines()
+            .filter(|line| !line.is_empty())
+            .collect::<Vec<_>>();
+        assert_eq!(lines.len(), 2, "{}", section);
+        assert!(lines[0].contains(&short_id(commits[1])) && lines[0].contains("first FAIL"));
+        assert!(lines[1].contains(&short_id(commits[3])) && lines[1].contains("first PASS again"));
+    }
+
+    #[test]
+    fn json_output_marks_transitions_on_the_commits() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(5);
+
+        let options = Options {
+            format: Format::Json,
+            stop_on_failure: false,
+            ..sh(commits[0], &fails_on(&[2, 3]))
+        };
+        let (runner, out) = repo.runner(options);
+        runner.run().unwrap();
+
+        // still an array of commits, with the flips marked on them
+        let json = json_commits(&out);
+        assert_eq!(json.len(), 5);
+        let transitions = json
+            .iter()
+            .filter_map(|value| value.get("transition"))
+            .collect::<Vec<_>>();
+        assert_eq!(transitions.len(), 2);
+        assert_eq!(json[1]["transition"]["label"], "first FAIL");
+        assert_eq!(json[1]["transition"]["previous"], commits[0].to_string());
+        assert_eq!(json[3]["transition"]["label"], "first PASS again");
+        assert_eq!(json[3]["transition"]["previous"], commits[2].to_string());
+    }
+
+    #[test]
+    fn tags_only_runs_on_tagged_commits_with_their_names() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(4);
+        let signature = repo.repo.signature().unwrap();
+        let second = repo.repo.find_object(commits[1], None).unwrap();
+        repo.repo.tag_lightweight("v1.0", &second, false).unwrap();
+        repo.repo
+            .tag("v1.0-final", &second, &signature, "release", false)
+            .unwrap();
+        let fourth = repo.repo.find_object(commits[3], None).unwrap();
+        repo.repo
+            .tag("v2.0", &fourth, &signature, "release", false)
+            .unwrap();
+
+        let options = Options {
+            walk: WalkOptions {
+                tags_only: true,
+                ..WalkOptions::default()
+            },
+            format: Format::Json,
+            ..sh(commits[0], &repo.record("echo $GIT_REV_TAGS"))
+        };
+        let (runner, out) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(oids(&results), [commits[1], commits[3]]);
+        assert_eq!(repo.recorded(), ["v1.0 v1.0-final", "v2.0"]);
+        let json = json_commits(&out);
+        assert_eq!(json[0]["tags"], serde_json::json!(["v1.0", "v1.0-final"]));
+        assert_eq!(json[1]["tags"], serde_json::json!(["v2.0"]));
+    }
+
+    #[test]
+    fn count_only_matches_a_real_run() {
+        let repo = TestRepo::new();
+        let [base, ..] = history_with_merge(&repo);
+        repo.commit_as("Other", "src change", &[("src/a", "a\n")]);
+        repo.commit("src again", &[("src/a", "b\n")]);
+        repo.commit("docs", &[("docs", "docs\n")]);
+
+        let walk = WalkOptions {
+            no_merges: true,
+            author: Some("test".to_string()),
+            grep: Some(Regex::new("^(main|side|src)").unwrap()),
+            ..WalkOptions::default()
+        };
+        let options = Options {
+            walk,
+            limit: Some(2),
+            ..sh(base, "true")
+        };
+        let (runner, out) = repo.runner(Options {
+            count_only: true,
+            command: Vec::new(),
+            ..options.clone()
+        });
+        let counted = runner.run().unwrap();
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert!(counted.commits.is_empty());
+        assert_eq!(out.contents(), format!("{}\n", results.commits.len()));
+        assert_eq!(results.commits.len(), 2);
+    }
+
+    #[test]
+    fn failing_before_stops_without_after_when_stopping_on_failure() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let before = format!("{}; exit 1", repo.record("echo before"));
+        let options = Options {
+            before: Some(before),
+            after: Some(repo.record("echo after")),
+            stop_on_failure: true,
+            ..sh(commits[0], &repo.record("echo command"))
+        };
+        let (runner, _) = repo.runner(options);
+        let results = runner.run().unwrap();
+
+        assert_eq!(results.commits.len(), 1);
+        assert_eq!(results.commits[0].outcome, Outcome::SetupFailed(1));
+        assert_eq!(repo.recorded(), ["before"]);
+    }
+
+    #[test]
+    fn failures_go_to_the_error_output() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let command = format!("echo oops >&2; {}", fails_on(&[1]));
+        let (runner, out, err) = repo.runner_with_errors(Options {
+            stop_on_failure: false,
+            after: Some("exit 3".to_string()),
+            ..sh(commits[0], &command)
+        });
+        runner.run().unwrap();
+
+        let (out, err) = (out.contents(), err.contents());
+        let failure = format!("Commit {} failed with exit code 1", commits[0]);
+        assert!(err.contains(&failure), "{}", err);
+        assert!(err.contains("oops"), "{}", err);
+        assert!(err.contains("--after command failed"), "{}", err);
+        assert!(!out.contains(&failure), "{}", out);
+        assert!(out.contains(&format!("Commit {} successful", commits[1])));
+    }
+
+    #[test]
+    fn verbose_reports_each_checkout_and_command() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let run = |verbosity| {
+            let (runner, _, err) = repo.runner_with_errors(Options {
+                verbosity,
+                ..sh(commits[0], "true")
+            });
+            runner.run().unwrap();
+            err.contents()
+        };
+        let quiet = run(Verbosity::Quiet);
+        let verbose = run(Verbosity::Verbose);
+
+        assert_eq!(quiet, "");
+        for oid in &commits {
+            assert!(
+                verbose.contains(&format!("Checking out {}", oid)),
+                "{}",
+                verbose
+            );
+            assert!(
+                verbose.contains(&format!("  GIT_REV_HASH={}", oid)),
+                "{}",
+                verbose
+            );
+        }
+        let running = format!(
+            r#"Running ["sh", "-c", "true"] in {}"#,
+            repo.path().display()
+        );
+        assert_eq!(verbose.matches(&running).count(), 2, "{}", verbose);
+    }
+
+    #[test]
+    fn quiet_leaves_out_notices() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+
+        let run = |verbosity| {
+            let (runner, _, err) = repo.runner_with_errors(Options {
+                verbosity,
+                revs: Some(vec![commits[0].to_string(), "no-such-rev".to_string()]),
+                after: Some("exit 1".to_string()),
+                ..sh(commits[0], "true")
+            });
+            runner.run().unwrap();
+            err.contents()
+        };
+        let quiet = run(Verbosity::Quiet);
+        let normal = run(Verbosity::Normal);
+
+        assert_eq!(quiet, "");
+        assert!(
+            normal.contains("Skipping revision no-such-rev"),
+            "{}",
+            normal
+        );
+        assert!(normal.contains("--after command failed"), "{}", normal);
+    }
+
+    #[test]
+    fn listing_commits_creates_no_collect_directory() {
+        let repo = TestRepo::new();
+        let commits = repo.commits(2);
+        let artifacts = TempDir::new("test-collect").unwrap();
+        let collect_dir = artifacts.path.join("out");
+
+        let options = Options {
+            collect: vec!["file".to_string()],
+            collect_dir: Some(collect_dir.clone()),
+            ..sh(commits[0], "true")
+        };
+        for options in [
+            Options {
+                dry_run: true,
+                ..options.clone()
+            },
+            Options {
+                count_only: true,
+                ..options
+            },
+        ] {
+            let (runner, _) = repo.runner(options);
+            runner.run().unwrap();
+            assert!(!collect_dir.exists());
+        }
+    }
+}
@@ -1,105 +1,582 @@
+mod config;
+
 use eyre::{Result, WrapErr};
 use git2::Repository;
-use std::fmt::Display;
-use std::path::PathBuf;
-use std::process::Command;
+use regex::RegexBuilder;
+use run_command_on_git_revisions::{
+    fetch, parse_date_bound, parse_range, read_skip_file, Direction, Format, Interrupt, Options,
+    ProgressStyle, Runner, Verbosity, WalkOptions,
+};
+use std::io::{IsTerminal, Read};
+use std::path::{Path, PathBuf};
+use std::time::Duration;
 use structopt::StructOpt;
 
 #[derive(Debug, StructOpt)]
+#[structopt(after_help = "ENVIRONMENT:
+    The command is run with these variables set, on top of the inherited environment:
+
+    GIT_REV_HASH            full hash of the commit
+    GIT_REV_SHORT           abbreviated hash of the commit
+    GIT_REV_AUTHOR          author name
+    GIT_REV_AUTHOR_EMAIL    author email
+    GIT_REV_DATE            author date, in RFC 3339 format
+    GIT_REV_SUBJECT         first line of the commit message
+    GIT_REV_TAGS            names of the tags pointing at the commit, separated by spaces
+
+    The --on-failure command also gets GIT_REV_EXIT, the failed command's exit code.
+
+PLACEHOLDERS:
+    The tokens {hash}, {short}, {author}, {date} and {subject} in the command's arguments are
+    replaced with the same values before it is run. Other tokens are left untouched, and {{
+    and }} produce literal braces.
+
+    Scripts run by the shell, with --shell and for --skip-if, --before, --after and
+    --on-failure, get a double quoted reference to the variable instead, such as
+    \"$GIT_REV_SUBJECT\", so that the shell never runs a commit's metadata as code. Leave these
+    tokens outside any quotes of your own.
+
+SHELL MODE:
+    By default the command and its arguments are run directly, so pipes, redirection and
+    `&&` have no special meaning. With --shell the arguments are joined with spaces and the
+    result is run by `sh -c` (`cmd /C` on Windows), which splits and interprets it again.
+    Quote the whole command as a single argument to keep it intact, e.g.
+
+        run-command-on-git-revisions --shell main~5..main -- 'make && ./run-tests | tee out.log'
+
+    The older form, with --start and --end and the command as one argument without `--`,
+    still runs it through the shell:
+
+        run-command-on-git-revisions -s main~5 -e main 'make && ./run-tests'
+
+CONFIG FILE:
+    Defaults for most options can be kept in a .run-on-revisions.toml file, looked for in the
+    --repo directory, or the current directory, and then each of its parents. Keys are the
+    long flag names, and flags given on the command line take precedence, e.g.
+
+        jobs = 4
+        timeout = \"10m\"
+        keep-going = true
+        path = [\"src\"]
+        before = \"make clean\"
+
+    Options which only apply to a single run, such as the range, --revs, --limit, --bisect
+    and --dry-run, can only be given on the command line. Relative paths other than path
+    filters are taken from the file's directory.
+
+    A flag the file turns on is turned off again with its --no- form, such as --no-shell or
+    --no-stash, or with --checkout, --merges and --color for --no-checkout, --no-merges and
+    --no-color.")]
 struct Opts {
-    /// Start ref
+    /// Start revision: a hash, which may be abbreviated, a branch or tag, or a relative ref
+    /// such as HEAD~5
     #[structopt(short, long)]
-    start: String,
-    /// End ref
+    start: Option<String>,
+    /// End revision, in the same forms as --start
     #[structopt(short, long)]
-    end: String,
-    /// Command to run on each commit
-    command: String,
+    end: Option<String>,
+    /// Run on exactly these revisions, in the order given, instead of a range. Separate them
+    /// with commas or newlines, or pass - to read them from stdin. History filters such as
+    /// --path and --reverse do not apply
+    #[structopt(long)]
+    revs: Option<String>,
+    /// Stop with an error if one of --revs cannot be resolved, instead of leaving it out
+    #[structopt(long)]
+    strict_revs: bool,
+    /// Revision range, START..END or START...END. With --start and --end or --revs there is no
+    /// range, and a single argument here is instead a command for the shell, see SHELL MODE
+    #[structopt(name = "RANGE")]
+    range: Option<String>,
+    /// The command and arguments to run on each commit, given after `--` so that they are
+    /// never mistaken for this tool's own flags
+    #[structopt(name = "COMMAND", last = true)]
+    command: Vec<String>,
+    /// Run the command through the shell, see SHELL MODE below
+    #[structopt(long)]
+    shell: bool,
+    /// Turn off --shell, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "shell")]
+    no_shell: bool,
     /// Path to repository (defaults to current directory)
+    #[structopt(short = "p", long = "repo")]
+    repo: Option<PathBuf>,
+    /// Read default options from this file instead of looking for .run-on-revisions.toml,
+    /// see CONFIG FILE below
+    #[structopt(long)]
+    config: Option<PathBuf>,
+    /// Ignore any .run-on-revisions.toml file
+    #[structopt(long)]
+    no_config: bool,
+    /// Fetch from a remote, origin unless given as --fetch=REMOTE, before resolving any
+    /// revisions, so that refs like origin/main or newly pushed tags are up to date
+    #[structopt(long, require_equals = true)]
+    fetch: Option<Option<String>>,
+    /// Only run on commits which change files under this path, relative to the repository
+    /// root. May be given more than once
+    #[structopt(long = "path", number_of_values = 1)]
+    paths: Vec<PathBuf>,
+    /// Number of commits to run the command on concurrently, each in its own worktree
+    #[structopt(short, long, default_value = "1")]
+    jobs: usize,
+    /// Kill the command if it runs for longer than this on any commit, e.g. "90s" or "5m"
+    #[structopt(long, parse(try_from_str = humantime::parse_duration))]
+    timeout: Option<Duration>,
+    /// Stop starting new commits once the whole run has taken this long, e.g. "30m". The
+    /// commits in progress are finished and the partial results reported, then the tool
+    /// exits with status 124
+    #[structopt(long, parse(try_from_str = humantime::parse_duration))]
+    max_runtime: Option<Duration>,
+    /// Count a zero exit code as a failure and any other as a pass, everywhere a pass or
+    /// failure matters: the summary, --stop-on-failure, --retries and --on-failure. With
+    /// --bisect this finds the first commit where the command succeeds, such as the one that
+    /// fixed a bug, given a start where it fails and an end where it passes
+    #[structopt(long)]
+    invert_exit: bool,
+    /// Turn off --invert-exit, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "invert-exit")]
+    no_invert_exit: bool,
+    /// Run the command up to this many more times on a commit when it exits with a failure,
+    /// counting the commit as passed if any attempt succeeds
+    #[structopt(long, default_value = "0")]
+    retries: u32,
+    /// How long to wait before each retry, e.g. "500ms" or "2s"
+    #[structopt(long, default_value = "0s", parse(try_from_str = humantime::parse_duration))]
+    retry_delay: Duration,
+    /// Stop at the first commit where the command fails (the default)
+    #[structopt(long)]
+    stop_on_failure: bool,
+    /// Run the command on every commit, even after a failure
+    #[structopt(long)]
+    keep_going: bool,
+    /// Walk from newest to oldest instead. Combined with --stop-on-failure this finds the
+    /// newest failing commit first
+    #[structopt(long)]
+    reverse: bool,
+    /// Turn off --reverse, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "reverse")]
+    no_reverse: bool,
+    /// Follow only the first parent of merge commits, like `git log --first-parent`
+    #[structopt(long)]
+    first_parent: bool,
+    /// Turn off --first-parent, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "first-parent")]
+    no_first_parent: bool,
+    /// Skip merge commits
+    #[structopt(long)]
+    no_merges: bool,
+    /// Turn off --no-merges, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "no-merges")]
+    merges: bool,
+    /// Only run on commits which a tag points at, whether lightweight or annotated
+    #[structopt(long)]
+    tags_only: bool,
+    /// Turn off --tags-only, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "tags-only")]
+    no_tags_only: bool,
+    /// Only run on commits whose message matches this regular expression
+    #[structopt(long)]
+    grep: Option<String>,
+    /// Select commits whose message does not match --grep instead
+    #[structopt(long)]
+    grep_invert: bool,
+    /// Turn off --grep-invert, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "grep-invert")]
+    no_grep_invert: bool,
+    /// Match --grep case-insensitively
+    #[structopt(long)]
+    grep_i: bool,
+    /// Turn off --grep-i, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "grep-i")]
+    no_grep_i: bool,
+    /// Only run on commits whose author name or email contains this, ignoring case
+    #[structopt(long)]
+    author: Option<String>,
+    /// Only run on commits authored at or after this RFC 3339 time or YYYY-MM-DD date (from
+    /// the start of the day, UTC)
+    #[structopt(long, parse(try_from_str = parse_since))]
+    since: Option<i64>,
+    /// Only run on commits authored at or before this RFC 3339 time or YYYY-MM-DD date (to
+    /// the end of the day, UTC)
+    #[structopt(long, parse(try_from_str = parse_until))]
+    until: Option<i64>,
+    /// Leave out the commits listed in this file, one full or abbreviated hash per line.
+    /// Blank lines and # comments are ignored
+    #[structopt(long)]
+    skip_file: Option<PathBuf>,
+    /// Write each commit's stdout and stderr to <short hash>.out and <short hash>.err in
+    /// this directory instead of the terminal
+    #[structopt(long)]
+    log_dir: Option<PathBuf>,
+    /// Stash uncommitted changes before the run and pop them again afterwards, instead of
+    /// refusing to run on a dirty working tree
+    #[structopt(long)]
+    stash: bool,
+    /// Turn off --stash, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "stash")]
+    no_stash: bool,
+    /// Overwrite untracked files that checking out a revision would clobber, like
+    /// `git checkout -f`, instead of refusing to run
+    #[structopt(long)]
+    force_checkout: bool,
+    /// Turn off --force-checkout, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "force-checkout")]
+    no_force_checkout: bool,
+    /// Export each commit's files to a temporary directory and run the command there, rather
+    /// than checking commits out in the repository
+    #[structopt(long)]
+    no_checkout: bool,
+    /// Turn off --no-checkout, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "no-checkout")]
+    checkout: bool,
+    /// Update submodules to the commits recorded in each revision after checking it out,
+    /// cloning or removing them as the revision requires
+    #[structopt(long)]
+    submodules: bool,
+    /// Turn off --submodules, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "submodules")]
+    no_submodules: bool,
+    /// Show how long the command took on each commit, with totals in the summary. Only the
+    /// command itself is timed, not the checkout
+    #[structopt(long)]
+    timing: bool,
+    /// Turn off --timing, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "timing")]
+    no_timing: bool,
+    /// Shell command deciding whether each commit is worth testing. Commits where it fails
+    /// are recorded as SKIPPED, count as neither passing nor failing, and are stepped around
+    /// when bisecting, like `git bisect skip`
+    #[structopt(long)]
+    skip_if: Option<String>,
+    /// Shell command to run before the command on each commit, with the same environment and
+    /// placeholders. If it fails the commit is recorded as SETUP_FAILED and the command is
+    /// skipped
+    #[structopt(long)]
+    before: Option<String>,
+    /// Shell command to run after the command on each commit, even if the command failed,
+    /// unless the run is stopping because of that failure
+    #[structopt(long)]
+    after: Option<String>,
+    /// Shell command to run whenever the command fails or times out on a commit, before the
+    /// run stops. GIT_REV_EXIT holds the exit code, and is empty after a timeout
+    #[structopt(long)]
+    on_failure: Option<String>,
+    /// Never colour the output. Colour is also left off stdout or stderr when it is not a
+    /// terminal, and off both when the NO_COLOR environment variable is set
+    #[structopt(long)]
+    no_color: bool,
+    /// Turn off --no-color, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "no-color")]
+    color: bool,
+    /// Copy files matching this glob, relative to the repository root, out of the working tree
+    /// after the command runs on each commit. May be given more than once. * does not cross
+    /// directories, while ** does
+    #[structopt(long, number_of_values = 1)]
+    collect: Vec<String>,
+    /// Directory to copy --collect files into, under a subdirectory named after each commit's
+    /// short hash and keeping their relative paths
+    #[structopt(long)]
+    collect_dir: Option<PathBuf>,
+    /// Only collect files from commits where the command passed
+    #[structopt(long)]
+    collect_passing_only: bool,
+    /// Turn off --collect-passing-only, as set in a config file
+    #[structopt(long, hidden = true, overrides_with = "collect-passing-only")]
+    no_collect_passing_only: bool,
+    /// Only report failures, and summarise the run in a single line
     #[structopt(short, long)]
-    path: Option<PathBuf>,
+    quiet: bool,
+    /// Also report each checkout, with the environment and full command line of everything
+    /// that is run
+    #[structopt(short, long)]
+    verbose: bool,
+    /// Output format for the results: "human", "json" or "csv". JSON is an array with an object
+    /// for each commit, which has a "transition" field when its result flipped
+    #[structopt(long, default_value = "human")]
+    format: Format,
+    /// Only process the first N commits in execution order, e.g. `--reverse --limit 5` runs
+    /// on the five newest
+    #[structopt(long)]
+    limit: Option<usize>,
+    /// Binary search for the first commit where the command fails, given a passing start and
+    /// a failing end, instead of running on every commit
+    #[structopt(long)]
+    bisect: bool,
+    /// Resume the previous run over the same range, skipping the commits it already
+    /// finished. Progress is saved in the repository's git directory after every commit
+    #[structopt(long = "continue")]
+    resume: bool,
+    /// List the commits that would be visited, in order, without running anything
+    #[structopt(short = "n", long)]
+    dry_run: bool,
+    /// Print only the number of commits that would be visited, after every filter and
+    /// --limit, without running anything. The command may be left out
+    #[structopt(long)]
+    count_only: bool,
 }
 
-#[tracing::instrument(skip(repo, start, end))]
-fn get_commits(
-    repo: &Repository,
-    start: impl Display,
-    end: impl Display,
-) -> Result<Vec<git2::Oid>> {
-    tracing::debug!(%start, %end, "getting commits");
-    let mut walk = repo.revwalk()?;
-    let range = format!("{start}..{end}", start = start, end = end);
-    walk.set_sorting(git2::Sort::REVERSE)?;
-    walk.push_range(&range).wrap_err("defining walk range")?;
-    Ok(walk.map(|oid| oid.unwrap()).collect::<Vec<_>>())
+/// Split a --revs list on commas and newlines, reading it from stdin when
+/// given as `-`
+fn read_revs(arg: &str) -> Result<Vec<String>> {
+    let list = if arg == "-" {
+        let mut list = String::new();
+        std::io::stdin()
+            .read_to_string(&mut list)
+            .wrap_err("reading revisions from stdin")?;
+        list
+    } else {
+        arg.to_string()
+    };
+    Ok(list
+        .split(&[',', '\n'][..])
+        .map(str::trim)
+        .filter(|rev| !rev.is_empty())
+        .map(str::to_string)
+        .collect())
 }
 
-fn checkout(repo: &Repository, oid: git2::Oid) -> Result<()> {
-    let obj = repo.revparse_single(&oid.to_string())?;
-    let mut checkout_options = git2::build::CheckoutBuilder::new();
-    checkout_options.force();
-    repo.checkout_tree(&obj, Some(&mut checkout_options))?;
-    repo.set_head_detached(obj.id())?;
-    Ok(())
+/// The command to run and whether it goes through the shell.
+///
+/// Before the command could follow `--` it was a single argument, given with
+/// --start and --end and always run by the shell, so a lone argument where
+/// the range would be is still taken that way.
+fn take_command(args: &mut Opts) -> (Vec<String>, bool) {
+    let needs_range = args.start.is_none() && args.revs.is_none();
+    if !needs_range && args.command.is_empty() {
+        if let Some(script) = args.range.take() {
+            return (vec![script], true);
+        }
+    }
+    (std::mem::take(&mut args.command), args.shell)
+}
+
+fn parse_since(s: &str) -> Result<i64> {
+    parse_date_bound(s, false)
 }
 
-fn with_reset(repo: &Repository, f: impl FnOnce(&Repository) -> Result<()>) -> Result<()> {
-    // get current commit by name
-    let h = repo.head().unwrap();
-    let commit = h.peel_to_commit().wrap_err("non-commit target")?;
-    let res = f(repo);
-    checkout(repo, commit.id()).wrap_err_with(|| format!("checking out commit {:?}", commit))?;
-    res
+fn parse_until(s: &str) -> Result<i64> {
+    parse_date_bound(s, true)
 }
 
+/// Exit status when --max-runtime cut the run short, matching timeout(1)
+const EXIT_OUT_OF_TIME: i32 = 124;
+
 #[tracing::instrument]
 fn main() -> Result<()> {
     color_eyre::install().unwrap();
     tracing_subscriber::fmt::init();
 
-    let args = Opts::from_args();
+    let matches = Opts::clap().get_matches();
+    let mut args = Opts::from_clap(&matches);
+
+    let repo_path = match args.repo.take() {
+        Some(path) => path,
+        None => std::env::current_dir().wrap_err("finding current directory")?,
+    };
+    if let Some(path) = config::choose(args.config.as_deref(), args.no_config, &repo_path)? {
+        tracing::debug!(path = %path.display(), "reading config file");
+        let dir = path.parent().unwrap_or_else(|| Path::new("."));
+        config::Config::load(&path)?.apply(&mut args, &matches, dir);
+    }
     tracing::trace!(?args, "parsed arguments");
 
-    // configure the thread pool
-    let repo_path = args.path.unwrap_or_else(|| PathBuf::from("."));
-    let repo = Repository::discover(&repo_path).wrap_err("finding repo")?;
-
-    let commits = get_commits(&repo, &args.start, &args.end).wrap_err("computing commits")?;
-    tracing::debug!(?commits, "got commits");
-
-    with_reset(&repo, |repo| {
-        for oid in commits {
-            tracing::trace!("checking out commit");
-            checkout(&repo, oid).unwrap();
-
-            let span = tracing::debug_span!("commit", sha = ?oid, command = ?args.command);
-            let _enter = span.enter();
-
-            tracing::info!("running user specified command");
-            let output = Command::new("bash")
-                .current_dir(&repo_path)
-                .args(&["-c", &args.command])
-                .output()
-                .expect("spawning user command");
-            let code = output.status.code().unwrap_or(1);
-
-            if output.status.success() {
-                let stdout = String::from_utf8(output.stdout).unwrap();
-                tracing::trace!(%stdout, %code, "successful exit code");
-                println!("Commit {:?} successful", oid);
-            } else {
-                let stderr = std::str::from_utf8(&output.stderr).unwrap();
-                tracing::trace!(%stderr, %code, "failed exit code");
-                eprintln!("Commit {:?} failed with exit code {}", oid, code);
-                let stderr = stderr.trim();
-                if !stderr.is_empty() {
-                    eprintln!("{}", stderr);
-                }
-            }
+    // discovery walks upwards, so the path may be anywhere inside the working tree
+    let repo = Repository::discover(&repo_path)
+        .wrap_err_with(|| format!("finding repo containing {}", repo_path.display()))?;
+
+    if let Some(remote) = &args.fetch {
+        fetch(&repo, remote.as_deref().unwrap_or("origin"))?;
+    }
+    let revs = args.revs.as_deref().map(read_revs).transpose()?;
+
+    let (command, shell) = take_command(&mut args);
+    if command.is_empty() && !args.count_only {
+        eyre::bail!("no command given, put the command and its arguments after --");
+    }
+
+    let (start, end) = match (args.start, args.end, &args.range) {
+        (None, None, Some(_)) if revs.is_some() => {
+            eyre::bail!("a revision range cannot be combined with --revs")
+        }
+        (None, None, None) if revs.is_some() => ("HEAD".to_string(), "HEAD".to_string()),
+        _ if revs.is_some() => eyre::bail!("--revs cannot be combined with --start or --end"),
+        (Some(_), Some(_), Some(_)) => {
+            eyre::bail!("a revision range cannot be combined with --start or --end")
+        }
+        (Some(start), Some(end), None) => (start, end),
+        (None, None, Some(range)) => parse_range(&repo, range)?,
+        (None, None, None) => {
+            eyre::bail!("either a revision range, both --start and --end, or --revs are required")
         }
-        Ok(())
-    })
-    .wrap_err("analysing repo")?;
+        _ => eyre::bail!("--start and --end must be given together"),
+    };
+
+    let direction = if args.reverse {
+        Direction::NewestFirst
+    } else {
+        Direction::OldestFirst
+    };
+    if (args.grep_invert || args.grep_i) && args.grep.is_none() {
+        eyre::bail!("--grep-invert and --grep-i need a pattern given with --grep");
+    }
+    let grep = args
+        .grep
+        .as_deref()
+        .map(|pattern| {
+            RegexBuilder::new(pattern)
+                .case_insensitive(args.grep_i)
+                .build()
+                .wrap_err_with(|| format!("invalid --grep pattern {}", pattern))
+        })
+        .transpose()?;
+
+    if args.collect.is_empty() != args.collect_dir.is_none() {
+        eyre::bail!("--collect and --collect-dir must be given together");
+    }
+
+    if args.quiet && args.verbose {
+        eyre::bail!("--quiet and --verbose cannot be used together");
+    }
+
+    if args.dry_run && args.count_only {
+        eyre::bail!("--dry-run and --count-only cannot be used together");
+    }
+
+    if args.stop_on_failure && args.keep_going {
+        eyre::bail!("--stop-on-failure and --keep-going cannot be used together");
+    }
+
+    // see https://no-color.org
+    let color =
+        !args.no_color && std::env::var_os("NO_COLOR").map_or(true, |value| value.is_empty());
+    let options = Options {
+        start,
+        end,
+        revs,
+        strict_revs: args.strict_revs,
+        command,
+        shell,
+        walk: WalkOptions {
+            first_parent: args.first_parent,
+            no_merges: args.no_merges,
+            paths: args.paths,
+            grep,
+            grep_invert: args.grep_invert,
+            author: args.author,
+            since: args.since,
+            until: args.until,
+            tags_only: args.tags_only,
+        },
+        exclude: match &args.skip_file {
+            Some(path) => read_skip_file(path)?,
+            None => Vec::new(),
+        },
+        direction,
+        limit: args.limit,
+        jobs: args.jobs,
+        timeout: args.timeout,
+        max_runtime: args.max_runtime,
+        retries: args.retries,
+        retry_delay: args.retry_delay,
+        stop_on_failure: !args.keep_going,
+        bisect: args.bisect,
+        resume: args.resume,
+        dry_run: args.dry_run,
+        count_only: args.count_only,
+        format: args.format,
+        log_dir: args.log_dir,
+        no_checkout: args.no_checkout,
+        submodules: args.submodules,
+        stash: args.stash,
+        force_checkout: args.force_checkout,
+        timing: args.timing,
+        skip_if: args.skip_if,
+        before: args.before,
+        after: args.after,
+        on_failure: args.on_failure,
+        invert_exit: args.invert_exit,
+        collect: args.collect,
+        collect_dir: args.collect_dir,
+        collect_passing_only: args.collect_passing_only,
+        color: color && std::io::stdout().is_terminal(),
+        color_stderr: color && std::io::stderr().is_terminal(),
+        verbosity: if args.quiet {
+            Verbosity::Quiet
+        } else if args.verbose {
+            Verbosity::Verbose
+        } else {
+            Verbosity::Normal
+        },
+        // machine readable output is usually collected by another program
+        progress: if args.format != Format::Human || args.quiet {
+            ProgressStyle::Off
+        } else if std::io::stderr().is_terminal() {
+            ProgressStyle::InPlace
+        } else {
+            ProgressStyle::Lines
+        },
+    };
+    // a dry run never starts a command, so leave ctrl-c with its default behaviour
+    let interrupt = if args.dry_run || args.count_only {
+        Interrupt::default()
+    } else {
+        Interrupt::install()?
+    };
+
+    let results = Runner::new(repo, options).interrupt(interrupt).run()?;
+    if let Some(signal) = results.signal {
+        // mirror the shell convention for processes killed by a signal
+        std::process::exit(128 + signal);
+    }
+    if results.out_of_time {
+        std::process::exit(EXIT_OUT_OF_TIME);
+    }
+    // a bisection is expected to find a failure, which is its result rather than an error
+    if results.first_bad.is_none() && !results.passed() {
+        std::process::exit(1);
+    }
 
     Ok(())
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn parse(args: &[&str]) -> Opts {
+        let matches =
+            Opts::clap().get_matches_from(["run-command-on-git-revisions"].iter().chain(args));
+        Opts::from_clap(&matches)
+    }
+
+    #[test]
+    fn a_lone_command_with_start_and_end_runs_in_the_shell() {
+        let mut args = parse(&["-s", "main~5", "-e", "main", "make && make test"]);
+        assert_eq!(
+            take_command(&mut args),
+            (vec!["make && make test".to_string()], true)
+        );
+        assert_eq!(args.range, None);
+    }
+
+    #[test]
+    fn a_command_after_the_range_runs_directly() {
+        let mut args = parse(&["main~5..main", "--", "make", "test"]);
+        assert_eq!(
+            take_command(&mut args),
+            (vec!["make".to_string(), "test".to_string()], false)
+        );
+        assert_eq!(args.range.as_deref(), Some("main~5..main"));
+
+        let mut args = parse(&["-s", "main~5", "-e", "main", "--", "make", "test"]);
+        assert_eq!(take_command(&mut args).1, false);
+    }
+
+    #[test]
+    fn flags_after_the_range_are_not_part_of_the_command() {
+        let mut args = parse(&["main~5..main", "--shell", "--", "make && make test"]);
+        assert_eq!(
+            take_command(&mut args),
+            (vec!["make && make test".to_string()], true)
+        );
+    }
+}